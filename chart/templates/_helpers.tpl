@@ -7,3 +7,11 @@ We truncate at 63 chars because some Kubernetes name fields are limited to this
 {{- define "fullname" -}}
 {{- printf "%s-%s" .Release.Name .Chart.Name | trunc 63 | trimSuffix "-" -}}
 {{- end -}}
+
+{{/*
+Names of the Secrets holding the admin keys of the additional backends, empty
+when all their keys are given in the values.
+*/}}
+{{- define "backendSecrets" -}}
+{{- range .Values.RGWBackends }}{{ .credentialsSecret }}{{ end -}}
+{{- end -}}
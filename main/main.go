@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -31,12 +32,11 @@ import (
 	"github.com/rgw-object-broker/pkg/server"
 )
 
-var options struct {
-	Port int
-}
+// returns the configuration flags set on the command line
+var configFlags func() map[string]string
 
 func init() {
-	flag.IntVar(&options.Port, "port", 8005, "use '--port' option to specify the port for broker to listen on")
+	configFlags = broker.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -60,9 +60,82 @@ func runWithContext(ctx context.Context) error {
 		fmt.Printf("%s/%s\n", path.Base(os.Args[0]), "UNKNOWN")
 		return nil
 	}
+	cfg, err := broker.LoadConfig(os.Environ(), configFlags())
+	if err != nil {
+		return err
+	}
+	if flag.Arg(0) == "chargeback" {
+		return chargeback(cfg, flag.Args()[1:])
+	}
+	if flag.Arg(0) == "orphans" {
+		return orphans(cfg, flag.Args()[1:])
+	}
+
+	addr := ":" + strconv.Itoa(cfg.Port)
+	return server.Run(ctx, addr, cfg.ReportAddr, broker.CreateBroker(cfg))
+}
+
+// chargeback writes the chargeback report of a time range to stdout or to a
+// file, e.g. "chargeback --start 2018-01-01 --end 2018-02-01 --format csv".
+func chargeback(cfg *broker.Config, args []string) error {
+	fs := flag.NewFlagSet("chargeback", flag.ExitOnError)
+	startFlag := fs.String("start", "", "start of the report, RFC 3339 or YYYY-MM-DD, defaults to the beginning of the month")
+	endFlag := fs.String("end", "", "end of the report, RFC 3339 or YYYY-MM-DD, defaults to now")
+	format := fs.String("format", broker.CHARGEBACK_CSV, "output format, csv or jsonl")
+	output := fs.String("output", "", "file to write the report to, defaults to stdout")
+	fs.Parse(args)
+
+	start, err := broker.ParseReportTime(*startFlag)
+	if err != nil {
+		return err
+	}
+	end, err := broker.ParseReportTime(*endFlag)
+	if err != nil {
+		return err
+	}
 
-	addr := ":" + strconv.Itoa(options.Port)
-	return server.Run(ctx, addr, broker.CreateBroker())
+	b, err := broker.CreateReportBroker(cfg)
+	if err != nil {
+		return err
+	}
+	report, err := b.Chargeback(start, end)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return report.Write(w, *format)
+}
+
+// orphans scans for the RGW users, keys and buckets the broker no longer
+// tracks and prints the report as JSON, e.g. "orphans --action quarantine
+// --min-age 72h". The scan locks what it changes like the running broker does,
+// so outside HA mode it must run in the broker pod, which holds the lock files.
+func orphans(cfg *broker.Config, args []string) error {
+	fs := flag.NewFlagSet("orphans", flag.ExitOnError)
+	action := fs.String("action", broker.ORPHAN_REPORT, "what to do with the orphans, report, quarantine or delete")
+	minAge := fs.Duration("min-age", broker.DEFAULT_ORPHAN_MIN_AGE, "orphans changed more recently are only reported")
+	fs.Parse(args)
+
+	b, err := broker.CreateReportBroker(cfg)
+	if err != nil {
+		return err
+	}
+	report, err := b.ScanOrphans(*action, *minAge)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
 }
 
 // cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.
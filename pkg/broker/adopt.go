@@ -0,0 +1,131 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+const (
+	ADOPT_BUCKET = "adoptBucket"
+)
+
+// Checks the optional "adoptBucket" parameter, and returns the entrypoint of the
+// bucket to adopt, or nil if no bucket is to be adopted. Only buckets owned by
+// the users listed in RGW_ADOPT_OWNERS can be adopted, never the ones of the
+// broker or of the backend admin user, and only by the namespaces listed in
+// RGW_ADOPT_NAMESPACES.
+func (b *broker) checkAdoptBucket(rgw *RGWClient, req *brokerapi.CreateServiceInstanceRequest) (*bucketEntrypointInfo, error) {
+	val, ok := req.Parameters[ADOPT_BUCKET]
+	if !ok {
+		return nil, nil
+	}
+	bucketName, ok := val.(string)
+	if !ok || bucketName == "" {
+		return nil, retErrInfof("Error: parameter %q must be a bucket name", ADOPT_BUCKET)
+	}
+	for _, param := range []string{BUCKET_NAME, BUCKETS, PLACEMENT} {
+		if _, ok := req.Parameters[param]; ok {
+			return nil, retErrInfof("Error: parameters %q and %q are mutually exclusive", ADOPT_BUCKET, param)
+		}
+	}
+
+	if b.naming.reserved[bucketName] {
+		return nil, retErrInfof("Error: bucket name %q is reserved", bucketName)
+	}
+
+	namespace := req.ContextProfile.Namespace
+	if !b.adoptNamespaces[namespace] {
+		return nil, retErrInfof("Error: namespace %q is not allowed to adopt buckets", namespace)
+	}
+
+	var status int
+	info, err := rgw.getBucketEntrypoint(bucketName, &status)
+	if status == http.StatusNotFound {
+		return nil, retErrInfof("Error: bucket %q to adopt not found", bucketName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	owner := info.Data.Owner
+	if owner == b.gcUser || strings.HasPrefix(owner, b.uidPrefix) {
+		return nil, retErrInfof("Error: bucket %q is owned by the broker and cannot be adopted", bucketName)
+	}
+	adminUser, err := rgw.adminUserID()
+	if err != nil {
+		return nil, err
+	}
+	if owner == adminUser {
+		return nil, retErrInfof("Error: bucket %q is owned by the admin user and cannot be adopted", bucketName)
+	}
+	if !b.adoptOwners[owner] {
+		return nil, retErrInfof("Error: buckets of user %q cannot be adopted", owner)
+	}
+	return info, nil
+}
+
+// Returns the uid of the user the admin keys of the backend belong to.
+func (rgw *RGWClient) adminUserID() (string, error) {
+	user, _ := rgw.credentials()
+	params := make(url.Values)
+	params.Set("access-key", user.accessKey)
+	body, err := rgw.rgwAdminRequest("GET", "user", "", params, nil)
+	if err != nil {
+		return "", retErrInfof("Error fetching admin user info: %v", err)
+	}
+
+	info := new(userInfo)
+	if err := json.Unmarshal(body, info); err != nil {
+		return "", retErrInfof("Error failed to unmarshal admin user info: %v", err)
+	}
+	if info.UserId == "" {
+		return "", retErrInfof("Error: admin user of backend %q not found", rgw.backend)
+	}
+	return info.UserId, nil
+}
+
+// Relinks the adopted bucket from its original owner to the instance user.
+func adoptBucket(rgw *RGWClient, info *bucketEntrypointInfo, userName string) error {
+	bucketName := info.Data.Bucket.Name
+	glog.Infof("Adopting bucket %s/%s", info.Data.Owner, bucketName)
+
+	if err := rgw.unlinkBucket(info.Data.Owner, bucketName); err != nil {
+		return err
+	}
+	return rgw.linkBucket(userName, bucketName, info.Data.Bucket.BucketId)
+}
+
+// Returns the user that receives the buckets of a removed instance. Adopted
+// buckets are returned to their original owner if it still exists, anything
+// else is parked under the gc user.
+func (b *broker) returnOwner(rgw *RGWClient, instance *rgwServiceInstance) string {
+	if instance.AdoptedFrom == "" {
+		return b.gcUser
+	}
+	if _, err := rgw.getUserInfo(instance.AdoptedFrom); err != nil {
+		glog.Errorf("Original owner %q of instance buckets not available, parking under gc user: %v", instance.AdoptedFrom, err)
+		return b.gcUser
+	}
+	return instance.AdoptedFrom
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+	"github.com/rs/xid"
+)
+
+const (
+	AUDIT_SINK_STDOUT = "stdout"
+	AUDIT_SINK_FILE   = "file"
+	AUDIT_SINK_BUCKET = "bucket"
+
+	AUDIT_SUCCESS = "success"
+	AUDIT_FAILURE = "failure"
+)
+
+// auditEntry records a broker operation, and its outcome.
+type auditEntry struct {
+	Time       time.Time            `json:"time"`
+	Operation  string               `json:"operation"`
+	InstanceID string               `json:"instanceId,omitempty"`
+	BindingID  string               `json:"bindingId,omitempty"`
+	Namespace  string               `json:"namespace,omitempty"`
+	Identity   *OriginatingIdentity `json:"identity,omitempty"`
+	PlanID     string               `json:"planId,omitempty"`
+	UserName   string               `json:"rgwUser,omitempty"`
+	Buckets    []string             `json:"buckets,omitempty"`
+	Prefix     string               `json:"prefix,omitempty"`
+	Outcome    string               `json:"outcome"`
+	Error      string               `json:"error,omitempty"`
+	DurationMs int64                `json:"durationMs"`
+}
+
+// auditSink stores audit entries. Sinks only ever append.
+type auditSink interface {
+	write(e *auditEntry) error
+}
+
+// writes JSON lines to stdout (stderr for the commands) or to a file
+type lineSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (s *lineSink) write(e *auditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// stores every entry as an object of its own under audit/<date>/ in the data
+// bucket
+type bucketSink struct {
+	b *broker
+}
+
+func (s *bucketSink) write(e *auditEntry) error {
+	oid := fmt.Sprintf("audit/%s/%s-%s", e.Time.Format("2006-01-02"), e.Time.Format("150405.000000"), xid.New().String())
+	return s.b.storeInfo(oid, e)
+}
+
+// Creates the audit sinks listed in RGW_AUDIT_SINKS. The file sink appends to
+// RGW_AUDIT_FILE.
+func newAuditSinks(b *broker, names []string, file string, stdout io.Writer) ([]auditSink, error) {
+	var sinks []auditSink
+	for _, name := range names {
+		switch name {
+		case AUDIT_SINK_STDOUT:
+			sinks = append(sinks, &lineSink{w: stdout})
+		case AUDIT_SINK_FILE:
+			if file == "" {
+				return nil, fmt.Errorf("RGW_AUDIT_FILE is needed by the %q audit sink", AUDIT_SINK_FILE)
+			}
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open audit file: %v", err)
+			}
+			sinks = append(sinks, &lineSink{w: f})
+		case AUDIT_SINK_BUCKET:
+			sinks = append(sinks, &bucketSink{b: b})
+		default:
+			return nil, fmt.Errorf("invalid audit sink %q, expected %q, %q or %q", name, AUDIT_SINK_STDOUT, AUDIT_SINK_FILE, AUDIT_SINK_BUCKET)
+		}
+	}
+	return sinks, nil
+}
+
+// auditedBroker records every operation of the broker in the audit sinks.
+type auditedBroker struct {
+	*broker
+	sinks []auditSink
+}
+
+// Fills in the details of the instance, if it exists.
+func (a *auditedBroker) describeInstance(e *auditEntry, instanceID string) {
+	instance, err := a.findInstance(instanceID)
+	if err != nil {
+		return
+	}
+	e.Namespace = instance.Namespace
+	e.PlanID = instance.PlanID
+	e.UserName = instance.UserName
+	e.Buckets = instance.bucketNames()
+	e.Prefix = instance.Prefix
+}
+
+func (a *auditedBroker) record(e *auditEntry, start time.Time, err error) {
+	e.Time = start.UTC()
+	e.DurationMs = int64(time.Since(start) / time.Millisecond)
+	e.Outcome = AUDIT_SUCCESS
+	if err != nil {
+		e.Outcome = AUDIT_FAILURE
+		e.Error = err.Error()
+	}
+	for _, sink := range a.sinks {
+		if err := sink.write(e); err != nil {
+			glog.Errorf("Failed to write audit entry of %s %s: %v", e.Operation, e.InstanceID, err)
+		}
+	}
+}
+
+func (a *auditedBroker) CreateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error) {
+	start := time.Now()
+	resp, err := a.broker.CreateServiceInstance(instanceID, req, identity)
+
+	e := &auditEntry{
+		Operation:  "provision",
+		InstanceID: instanceID,
+		Namespace:  req.ContextProfile.Namespace,
+		Identity:   identity,
+		PlanID:     req.PlanID,
+	}
+	if err == nil {
+		a.describeInstance(e, instanceID)
+	}
+	a.record(e, start, err)
+	return resp, err
+}
+
+func (a *auditedBroker) UpdateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error) {
+	start := time.Now()
+	resp, err := a.broker.UpdateServiceInstance(instanceID, req, identity)
+
+	e := &auditEntry{Operation: "update", InstanceID: instanceID, Identity: identity}
+	a.describeInstance(e, instanceID)
+	a.record(e, start, err)
+	return resp, err
+}
+
+func (a *auditedBroker) RemoveServiceInstance(instanceID, serviceID, planID string, acceptsIncomplete bool, identity *OriginatingIdentity) (*brokerapi.DeleteServiceInstanceResponse, error) {
+	// the instance is gone afterwards
+	e := &auditEntry{Operation: "deprovision", InstanceID: instanceID, Identity: identity}
+	a.describeInstance(e, instanceID)
+
+	start := time.Now()
+	resp, err := a.broker.RemoveServiceInstance(instanceID, serviceID, planID, acceptsIncomplete, identity)
+	a.record(e, start, err)
+	return resp, err
+}
+
+func (a *auditedBroker) Bind(instanceID, bindingID string, req *brokerapi.BindingRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceBindingResponse, error) {
+	e := &auditEntry{Operation: "bind", InstanceID: instanceID, BindingID: bindingID, Identity: identity}
+	a.describeInstance(e, instanceID)
+
+	start := time.Now()
+	resp, err := a.broker.Bind(instanceID, bindingID, req, identity)
+	a.record(e, start, err)
+	return resp, err
+}
+
+func (a *auditedBroker) UnBind(instanceID, bindingID, serviceID, planID string, identity *OriginatingIdentity) error {
+	e := &auditEntry{Operation: "unbind", InstanceID: instanceID, BindingID: bindingID, Identity: identity}
+	a.describeInstance(e, instanceID)
+
+	start := time.Now()
+	err := a.broker.UnBind(instanceID, bindingID, serviceID, planID, identity)
+	a.record(e, start, err)
+	return err
+}
+
+func (a *auditedBroker) InstanceUsage(instanceID string, start, end time.Time) (*InstanceUsage, error) {
+	now := time.Now()
+	usage, err := a.broker.InstanceUsage(instanceID, start, end)
+	a.record(&auditEntry{Operation: "usage", InstanceID: instanceID}, now, err)
+	return usage, err
+}
+
+func (a *auditedBroker) NamespaceUsage(namespace string, start, end time.Time) (*NamespaceUsage, error) {
+	now := time.Now()
+	usage, err := a.broker.NamespaceUsage(namespace, start, end)
+	a.record(&auditEntry{Operation: "usage", Namespace: namespace}, now, err)
+	return usage, err
+}
+
+func (a *auditedBroker) Chargeback(start, end time.Time) (*ChargebackReport, error) {
+	now := time.Now()
+	report, err := a.broker.Chargeback(start, end)
+	a.record(&auditEntry{Operation: "chargeback"}, now, err)
+	return report, err
+}
+
+// Records the scan, and every orphan it changed.
+func (a *auditedBroker) ScanOrphans(action string, minAge time.Duration) (*OrphanReport, error) {
+	now := time.Now()
+	report, err := a.broker.ScanOrphans(action, minAge)
+	a.record(&auditEntry{Operation: "orphans-" + action}, now, err)
+	if report == nil {
+		return report, err
+	}
+
+	changed := func(result string) bool {
+		return result != ORPHAN_FOUND && result != ORPHAN_TOO_RECENT
+	}
+	orphanErr := func(msg string) error {
+		if msg == "" {
+			return nil
+		}
+		return errors.New(msg)
+	}
+	for _, u := range report.Users {
+		if changed(u.Result) {
+			a.record(&auditEntry{Operation: "orphan-user-" + action, UserName: u.UserName, Buckets: u.Buckets}, now, orphanErr(u.Error))
+		}
+	}
+	for _, k := range report.Keys {
+		if changed(k.Result) {
+			a.record(&auditEntry{Operation: "orphan-key-" + action, InstanceID: k.InstanceID, UserName: k.UserName}, now, orphanErr(k.Error))
+		}
+	}
+	for _, o := range report.Buckets {
+		if changed(o.Result) {
+			a.record(&auditEntry{Operation: "orphan-bucket-" + action, InstanceID: o.InstanceID, UserName: o.Owner, Buckets: []string{o.Bucket}}, now, orphanErr(o.Error))
+		}
+	}
+	return report, err
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+const (
+	// the backend configured through RGW_ENDPOINT, which also holds the
+	// broker's data bucket
+	DEFAULT_BACKEND = "default"
+
+	BACKEND = "backend"
+)
+
+// Returns the prefix of the environment variables configuring a named backend,
+// e.g. RGW_BACKEND_ARCHIVE_ for "archive".
+func backendEnvPrefix(name string) string {
+	return "RGW_BACKEND_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+}
+
+// Creates the client of a named backend.
+func newBackendClient(cfg BackendConfig) *RGWClient {
+	return &RGWClient{
+		backend:         cfg.Name,
+		endpoint:        cfg.Endpoint,
+		zonegroup:       cfg.Zonegroup,
+		websiteEndpoint: cfg.WebsiteEndpoint,
+		user: RGWUser{
+			accessKey: cfg.AccessKey,
+			secret:    cfg.Secret,
+		},
+	}
+}
+
+// Initializes the s3 client of a backend, and creates its gc user if needed.
+func (c *RGWClient) initBackend(gcUser string, provisionGC bool) error {
+	if c.zonegroup == "" {
+		glog.Infof("NOTICE: zonegroup of backend %q was not configured, using 'default'.", c.backend)
+		c.zonegroup = "default"
+	}
+
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	if provisionGC {
+		_, err := c.provisionUser(gcUser, "rgw-broker-gc-"+gcUser, false, true)
+		if err != nil {
+			return fmt.Errorf("failed to create a user for broker gc: %v", err)
+		}
+	}
+	glog.Infof("Backend %q: rgw endpoint %s", c.backend, c.endpoint)
+	return nil
+}
+
+// Returns the client of the named backend. An empty name selects the default
+// backend, which is what instances created before backends existed use.
+func (b *broker) getBackend(name string) (*RGWClient, error) {
+	if name == "" {
+		name = DEFAULT_BACKEND
+	}
+	c, ok := b.backends[name]
+	if !ok {
+		return nil, retErrInfof("Error: backend %q not found", name)
+	}
+	return c, nil
+}
+
+// Selects the backend of a new instance: the "backend" parameter if given,
+// otherwise the backend mapped to the plan, otherwise the default backend.
+// The parameter may only name the default backend, the plan's backend or a
+// backend that allows the namespace of the instance.
+func (b *broker) selectBackend(plan *rgwPlan, req *brokerapi.CreateServiceInstanceRequest) (*RGWClient, error) {
+	name := b.planBackends[plan.name]
+	if val, ok := req.Parameters[BACKEND]; ok {
+		param, ok := val.(string)
+		if !ok {
+			return nil, retErrInfof("Error: parameter %q must be a backend name", BACKEND)
+		}
+		if err := b.checkBackendAllowed(param, plan, req.ContextProfile.Namespace); err != nil {
+			return nil, err
+		}
+		name = param
+	}
+	return b.getBackend(name)
+}
+
+func (b *broker) checkBackendAllowed(name string, plan *rgwPlan, namespace string) error {
+	if name == DEFAULT_BACKEND || name == b.planBackends[plan.name] {
+		return nil
+	}
+	if _, ok := b.backends[name]; !ok {
+		return retErrInfof("Error: backend %q not found", name)
+	}
+	if !b.backendNamespaces[name][namespace] {
+		return retErrInfof("Error: namespace %q is not allowed to use backend %q", namespace, name)
+	}
+	return nil
+}
+
+func (b *broker) instanceBackend(instance *rgwServiceInstance) (*RGWClient, error) {
+	return b.getBackend(instance.Backend)
+}
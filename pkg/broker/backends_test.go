@@ -0,0 +1,64 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"testing"
+)
+
+func TestCheckBackendAllowed(t *testing.T) {
+	b := &broker{
+		backends: map[string]*RGWClient{
+			DEFAULT_BACKEND: {},
+			"archive":       {},
+			"fast":          {},
+		},
+		planBackends: map[string]string{"cold": "archive"},
+		backendNamespaces: map[string]map[string]bool{
+			"archive": {},
+			"fast":    {"analytics": true},
+		},
+	}
+	cold := &rgwPlan{name: "cold"}
+	hot := &rgwPlan{name: "hot"}
+
+	tests := []struct {
+		name      string
+		backend   string
+		plan      *rgwPlan
+		namespace string
+		wantErr   bool
+	}{
+		{name: "default backend", backend: DEFAULT_BACKEND, plan: hot, namespace: "team-a"},
+		{name: "backend of the plan", backend: "archive", plan: cold, namespace: "team-a"},
+		{name: "allowed namespace", backend: "fast", plan: hot, namespace: "analytics"},
+		{name: "other namespace", backend: "fast", plan: hot, namespace: "team-a", wantErr: true},
+		{name: "backend of another plan", backend: "archive", plan: hot, namespace: "analytics", wantErr: true},
+		{name: "unknown backend", backend: "missing", plan: hot, namespace: "analytics", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.checkBackendAllowed(tt.backend, tt.plan, tt.namespace)
+			if tt.wantErr && err == nil {
+				t.Errorf("checkBackendAllowed(%q) succeeded, want an error", tt.backend)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("checkBackendAllowed(%q) = %v, want no error", tt.backend, err)
+			}
+		})
+	}
+}
@@ -18,9 +18,9 @@ package broker
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"time"
+	"sort"
 	"bytes"
         "encoding/binary"
 	"crypto/rand"
@@ -30,9 +30,11 @@ import (
 	"github.com/rs/xid"
 	"net/http"
 	"net/url"
+	"os"
 	"sync"
 	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
         "github.com/aws/aws-sdk-go/aws"
+        "github.com/aws/aws-sdk-go/aws/awserr"
         "github.com/aws/aws-sdk-go/aws/credentials"
         "github.com/aws/aws-sdk-go/aws/session"
         "github.com/aws/aws-sdk-go/aws/signer/v4"
@@ -46,6 +48,7 @@ const (
 	USER_NAME       = "userName"
 	BUCKET_ENDPOINT = "bucketEndpoint"
 	BUCKET_NAME     = "bucketName"
+	BUCKETS         = "buckets"
 	ACCESS_KEY      = "accessKey"
 	SECRET_KEY	= "secretKey"
 )
@@ -56,11 +59,65 @@ type rgwServiceInstance struct {
         Endpoint string
 	UserName string
         BucketName string
+	PlanID string `json:",omitempty"`
+	// prefix inside the shared bucket, set for shared bucket plan instances
+	Prefix string `json:",omitempty"`
+	// original owner of an adopted bucket, which gets the bucket back when
+	// the instance is removed
+	AdoptedFrom string `json:",omitempty"`
+	// name of the backend holding the instance, empty for the default one
+	Backend string `json:",omitempty"`
+	// placement target and default storage class of the instance buckets
+	Placement rgwPlacement
+	// "enabled" or "suspended", empty if never configured
+	Versioning string `json:",omitempty"`
+	Lifecycle []lifecycleRule `json:",omitempty"`
+	Cors []corsRule `json:",omitempty"`
+	// buckets were created with Object Lock enabled
+	ObjectLock bool `json:",omitempty"`
+	Retention *objectRetention `json:",omitempty"`
+	// longest retention the buckets ever had, which objects written under it
+	// keep when the retention is shortened
+	LongestRetention *objectRetention `json:",omitempty"`
+	// default encryption of the buckets, and the KMS key used for SSE-KMS
+	Encryption string `json:",omitempty"`
+	KmsKeyID string `json:",omitempty"`
+	// topic the bucket events are sent to
+	TopicArn string `json:",omitempty"`
+	// url the bucket website is served at, for website plans
+	WebsiteEndpoint string `json:",omitempty"`
+	// user quota, counted against the storage cap of the namespace
+	QuotaBytes int64 `json:",omitempty"`
+	// access key created with the user of a bucket instance, which is not
+	// part of any binding
+	ProvisioningKey string `json:",omitempty"`
+	// parameters that can't be changed by updates, as given at creation
+	CreateParameters map[string]interface{} `json:",omitempty"`
+	// platform users that created and last updated the instance
+	CreatedBy *OriginatingIdentity `json:",omitempty"`
+	LastModifiedBy *OriginatingIdentity `json:",omitempty"`
+	// maps the logical names requested through the "buckets" parameter to
+	// the actual bucket names, empty for single bucket instances
+	Buckets map[string]string `json:",omitempty"`
+}
+
+// Returns the names of all the buckets owned by the instance.
+func (i *rgwServiceInstance) bucketNames() []string {
+	if len(i.Buckets) == 0 {
+		return []string{i.BucketName}
+	}
+	names := make([]string, 0, len(i.Buckets))
+	for _, name := range i.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 type rgwBindInfo struct {
 	// binding credential created during Bind()
 	Credential brokerapi.Credential // s3 server url, includes port and bucket name
+	CreatedBy *OriginatingIdentity `json:",omitempty"`
 }
 
 type RGWUser struct {
@@ -70,14 +127,21 @@ type RGWUser struct {
 }
 
 type RGWClient struct {
+        // name of the backend the client talks to, empty for instance users
+        backend         string
         endpoint        string
         zonegroup       string
+        // serves the bucket websites, empty if the backend doesn't
+        websiteEndpoint string
+        // guards user, which is replaced when the admin keys are rotated
+        credsLock       sync.RWMutex
+        credsGeneration int
         user            RGWUser
         client          *s3.S3
 }
 
 func (c *RGWClient) init() error {
-        client, err := getS3Client(c.user, c.endpoint, c.zonegroup)
+        client, err := getS3Client(c.user.accessKey, credentials.NewCredentials(&rotatingCredentials{c: c}), c.endpoint, c.zonegroup)
 
         if err != nil {
                 return fmt.Errorf("getS3Client failed: %v", err)
@@ -86,18 +150,32 @@ func (c *RGWClient) init() error {
         return nil
 }
 
+type bucketOptions struct {
+	// placement target, empty for the zonegroup's default placement
+	placement  string
+	objectLock bool
+}
+
 // Creates an bucket
-func (c *RGWClient) createBucket(bucketName string) error {
+func (c *RGWClient) createBucket(bucketName string, opts bucketOptions) error {
 	glog.Infof("Creating bucket %q", bucketName)
 
+        location := c.zonegroup
+        if opts.placement != "" {
+                location += ":" + opts.placement
+        }
+
         config := s3.CreateBucketConfiguration{
-                LocationConstraint: &c.zonegroup,
+                LocationConstraint: &location,
         }
 
         input := s3.CreateBucketInput{
                 Bucket: &bucketName,
                 CreateBucketConfiguration: &config,
         }
+        if opts.objectLock {
+                input.ObjectLockEnabledForBucket = aws.Bool(true)
+        }
 
 	_, err := c.client.CreateBucket(&input)
 	if err != nil {
@@ -107,17 +185,66 @@ func (c *RGWClient) createBucket(bucketName string) error {
 	return nil
 }
 
+// Deletes an empty bucket, succeeding if it doesn't exist.
+func (c *RGWClient) deleteBucket(bucketName string) error {
+	glog.Infof("Deleting bucket %q", bucketName)
+
+	_, err := c.client.DeleteBucket(&s3.DeleteBucketInput{Bucket: &bucketName})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil
+	}
+	if err != nil {
+		return retErrInfof("Error deleting bucket: %v", err)
+	}
+	return nil
+}
+
 type broker struct {
-	// rwMutex controls concurrent R and RW access
-	rwMutex	    sync.RWMutex
+	// serialises the operations on the same instance, see lock()
+	keyedLocks  *keyedLocks
+	// mapLock guards instanceMap
+	mapLock     sync.RWMutex
 	// instanceMap maps instanceIDs to the ID's userProvidedServiceInstance values
 	instanceMap map[string]*rgwServiceInstance
 
-        rgw         RGWClient
+        // client of the default backend, which holds the data bucket
+        rgw         *RGWClient
+        // clients of all the backends, including the default one
+        backends    map[string]*RGWClient
+        // maps plan names to the backend their instances are created on
+        planBackends map[string]string
+	// namespaces allowed to pick each additional backend through the
+	// "backend" parameter
+	backendNamespaces map[string]map[string]bool
+        // maps plan names to the placement of their instances
+        planPlacements map[string]rgwPlacement
 
 	uidPrefix   string
 	gcUser      string
 	dataBucket  string
+	naming      *bucketNamePolicy
+	// namespaces allowed to adopt existing buckets, and the users whose
+	// buckets they may adopt
+	adoptNamespaces map[string]bool
+	adoptOwners map[string]bool
+	sharedBucket string
+	// hosts the bucket events may be pushed to
+	notificationHosts []string
+	// gc mode for the prefixes of removed shared bucket instances
+	sharedPrefixGC string
+	// smallest minimum age of the orphan scans
+	orphanMinAgeFloor time.Duration
+	// creates the keys of SSE-KMS instances, nil when no kms is configured
+	kms keyManager
+	// externally reachable url of the report listener, for the instance
+	// dashboards
+	reportURL string
+	// limits of the namespaces, nil when every namespace is unlimited
+	policy *namespacePolicy
+	// serialises the operations on the same instance across the replicas
+	locks lockManager
+	// other replicas may change the records, so they are never cached
+	ha bool
 
 	// client used to access kubernetes
 	kubeClient  *clientset.Clientset
@@ -129,104 +256,216 @@ type bucketInstance struct {
         bucketName      string
 }
 
-// Initialize the rgw service broker. This function is called by `server.Start()`.
-func CreateBroker() Broker {
-	var instanceMap = make(map[string]*rgwServiceInstance)
+// Initialize the rgw service broker from its configuration, see LoadConfig.
+// This function is called by `server.Start()`.
+func CreateBroker(cfg *Config) Broker {
 	glog.Info("Generating new Ceph rgw object broker.")
 
 	// get the kubernetes client
 	cs, err := getKubeClient()
 	if err != nil {
 		glog.Fatalf("failed to get kubernetes client: %v\n", err)
-                return nil
+		return nil
 	}
 
-        client := RGWClient{}
-        uidPrefix := "kube-rgw."
-        dataBucket := "kube-rgw-data"
-        gcUser := ""
+	b, err := newBroker(cfg, cs)
+	if err != nil {
+		glog.Fatalf("Error: %v", err)
+		return nil
+	}
 
-        for _, e := range os.Environ() {
-                pair := strings.Split(e, "=")
-                switch pair[0] {
-		case "RGW_ENDPOINT":
-                        client.endpoint = pair[1]
-		case "RGW_ZONEGROUP":
-                        client.zonegroup = pair[1]
-		case "RGW_ACCESS_KEY":
-                        client.user.accessKey = pair[1]
-		case "RGW_SECRET":
-                        client.user.secret = pair[1]
-		case "RGW_UID_PREFIX":
-                        uidPrefix = pair[1]
-		case "RGW_GC_USER":
-                        gcUser = pair[1]
-		case "RGW_DATA_BUCKET":
-                        dataBucket = pair[1]
+	provisionGC := cfg.GCUser == ""
+	for name, c := range b.backends {
+		if err := c.initBackend(b.gcUser, provisionGC); err != nil {
+			glog.Fatalf("failed to initialize backend %q: %v\n", name, err)
+			return nil
 		}
-        }
+	}
 
-        if client.zonegroup == "" {
-                glog.Infof("NOTICE: RGWZoneGroup was not configured, using 'default'.")
-                client.zonegroup = "default"
-        }
+	err = b.rgw.createBucket(cfg.DataBucket, bucketOptions{})
+	if err != nil {
+		glog.Fatalf("Error: failed to create bucket %s", cfg.DataBucket)
+		return nil
+	}
 
-	// get the s3 client
-	err = client.init()
+	glog.Infof("New Broker for rgw endpoint: %s", b.rgw.endpoint)
+
+	go watchCredentials(credentialSources(cfg, b.backends), time.Duration(cfg.CredentialsPollSeconds)*time.Second)
+
+	sinks, err := newAuditSinks(b, cfg.AuditSinks, cfg.AuditFile, os.Stdout)
 	if err != nil {
-		glog.Fatalf("failed to get s3 client: %v\n", err)
+		glog.Fatalf("Error: %v", err)
+		return nil
 	}
+	return &auditedBroker{broker: b, sinks: sinks}
+}
 
-        if gcUser == "" {
-                gcUser = "rgw-kube-gc-user"
-                _, err := client.provisionUser(gcUser, "rgw-broker-gc-" + gcUser, false, true)
-                if err != nil {
-                        glog.Fatalf("failed to create a user for broker gc: %v\n", err)
-                        return nil
-                }
-        }
+// CreateReportBroker initializes a broker for the commands run next to a
+// running broker, such as the chargeback report. Unlike CreateBroker it
+// doesn't create the gc user or the data bucket, doesn't watch the credential
+// files, and only needs a kubernetes client in HA mode, for the locks. Outside
+// HA mode it shares the lock files of the broker, and must run in its pod.
+func CreateReportBroker(cfg *Config) (Broker, error) {
+	var cs *clientset.Clientset
+	if cfg.HA {
+		var err error
+		if cs, err = getKubeClient(); err != nil {
+			return nil, fmt.Errorf("failed to get kubernetes client: %v", err)
+		}
+	}
 
-        err = client.createBucket(dataBucket)
-        if (err != nil) {
-                glog.Fatalf("Error: failed to create bucket %s", dataBucket)
-                return nil
-        }
+	b, err := newBroker(cfg, cs)
+	if err != nil {
+		return nil, err
+	}
+	for name, c := range b.backends {
+		if err := c.initBackend(b.gcUser, false); err != nil {
+			return nil, fmt.Errorf("failed to initialize backend %q: %v", name, err)
+		}
+	}
 
-	glog.Infof("New Broker for rgw endpoint: %s", client.endpoint)
-	return &broker{
-		instanceMap: instanceMap,
-		rgw:         client,
-		kubeClient:  cs,
-		uidPrefix:   uidPrefix,
-                gcUser:      gcUser,
-                dataBucket:  dataBucket,
+	// the standard output carries the output of the commands
+	sinks, err := newAuditSinks(b, cfg.AuditSinks, cfg.AuditFile, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return &auditedBroker{broker: b, sinks: sinks}, nil
+}
+
+// Builds the broker from its configuration, without talking to RGW.
+func newBroker(cfg *Config, cs *clientset.Clientset) (*broker, error) {
+	client := newBackendClient(BackendConfig{
+		Name:            DEFAULT_BACKEND,
+		Endpoint:        cfg.Endpoint,
+		Zonegroup:       cfg.Zonegroup,
+		WebsiteEndpoint: cfg.WebsiteEndpoint,
+		AccessKey:       cfg.AccessKey,
+		Secret:          cfg.Secret,
+	})
+	backends := map[string]*RGWClient{DEFAULT_BACKEND: client}
+	backendNamespaces := make(map[string]map[string]bool)
+	for _, backend := range cfg.Backends {
+		backends[backend.Name] = newBackendClient(backend)
+		backendNamespaces[backend.Name] = make(map[string]bool)
+		for _, ns := range backend.Namespaces {
+			backendNamespaces[backend.Name][ns] = true
+		}
+	}
+
+	planBackends := make(map[string]string)
+	for plan, backend := range cfg.PlanBackends {
+		planBackends[plan] = backend
+	}
+	planPlacements := make(map[string]rgwPlacement)
+	for plan, placement := range cfg.PlanPlacements {
+		planPlacements[plan] = parsePlacement(placement)
+	}
+
+	adoptNamespaces := make(map[string]bool)
+	for _, ns := range cfg.AdoptNamespaces {
+		adoptNamespaces[ns] = true
+	}
+	adoptOwners := make(map[string]bool)
+	for _, owner := range cfg.AdoptOwners {
+		adoptOwners[owner] = true
+	}
+
+	naming := newBucketNamePolicy()
+	naming.template = cfg.BucketNameTemplate
+	for _, name := range cfg.BucketReservedNames {
+		naming.reserved[name] = true
+	}
+	naming.allowedPrefixes = cfg.BucketAllowedPrefixes
+	naming.deniedPrefixes = cfg.BucketDeniedPrefixes
+	naming.reserved[cfg.DataBucket] = true
+	naming.reserved[cfg.SharedBucket] = true
+
+	var policy *namespacePolicy
+	if cfg.NamespacePolicy != "" {
+		var err error
+		if policy, err = loadNamespacePolicy(cfg.NamespacePolicy); err != nil {
+			return nil, err
+		}
 	}
+
+	var locks lockManager
+	if cfg.HA {
+		locks = newConfigMapLocks(cs.CoreV1(), cfg.LockNamespace,
+			time.Duration(cfg.LockTTLSeconds)*time.Second, time.Duration(cfg.LockTimeoutSeconds)*time.Second)
+		glog.Infof("HA mode, locking instances with ConfigMaps in namespace %s", cfg.LockNamespace)
+	} else {
+		fl, err := newFileLocks(cfg.LockDir, time.Duration(cfg.LockTimeoutSeconds)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		locks = fl
+	}
+
+	gcUser := cfg.GCUser
+	if gcUser == "" {
+		gcUser = "rgw-kube-gc-user"
+	}
+
+	return &broker{
+		keyedLocks:        newKeyedLocks(),
+		instanceMap:       make(map[string]*rgwServiceInstance),
+		rgw:               client,
+		backends:          backends,
+		planBackends:      planBackends,
+		backendNamespaces: backendNamespaces,
+		planPlacements:    planPlacements,
+		kubeClient:        cs,
+		uidPrefix:         cfg.UIDPrefix,
+		gcUser:            gcUser,
+		dataBucket:        cfg.DataBucket,
+		adoptNamespaces:   adoptNamespaces,
+		adoptOwners:       adoptOwners,
+		naming:            naming,
+		sharedBucket:      cfg.SharedBucket,
+		sharedPrefixGC:    cfg.SharedPrefixGC,
+		orphanMinAgeFloor: time.Duration(cfg.OrphanMinAgeFloorSeconds) * time.Second,
+		notificationHosts: cfg.NotificationHosts,
+		kms:               newKeyManager(cfg.KMS),
+		reportURL:         strings.TrimSuffix(cfg.ReportURL, "/"),
+		policy:            policy,
+		locks:             locks,
+		ha:                cfg.HA,
+	}, nil
 }
+
 // Implements the `Catalog` interface method.
 func (b *broker) Catalog() (*brokerapi.Catalog, error) {
+	plans := make([]brokerapi.ServicePlan, 0, len(rgwPlans))
+	for i := range rgwPlans {
+		if _, ok := b.planPlacements[rgwPlans[i].name]; rgwPlans[i].needsPlacement && !ok {
+			continue
+		}
+		if rgwPlans[i].encryption == SSE_KMS && b.kms == nil {
+			continue
+		}
+		if rgwPlans[i].website && !b.websiteConfigured(&rgwPlans[i]) {
+			continue
+		}
+		plan := rgwPlans[i].servicePlan()
+		plan.Schemas = b.planSchemas(&rgwPlans[i])
+		plans = append(plans, plan)
+	}
 	return &brokerapi.Catalog{
 		Services: []*brokerapi.Service{
 			{
 				Name:        "rgw-bucket-service",
-				ID:          "3594c8a0-5aad-42b6-8809-dc367d1bbaed",
+				ID:          SERVICE_ID,
 				Description: "A bucket of storage object backed by Ceph RGW.",
 				Bindable:    true,
-				Plans: []brokerapi.ServicePlan{
-					{
-						Name:        "default",
-						ID:          "3594c8a0-5aad-42b6-8809-dc367d1bbaed",
-						Description: "The best plan, and the only one.",
-						Free:        true,
-					},
-				},
+				Plans:       plans,
 			},
 		},
 	}, nil
 }
 
 func (b *broker) findInstance(instanceID string) (*rgwServiceInstance, error) {
-	instance, ok := b.instanceMap[instanceID]
-	if !ok {
+	instance, ok := b.cachedInstance(instanceID)
+	if !ok || b.ha {
                 var err error
                 instance, err = b.getInstanceInfo(instanceID)
                 if err != nil {
@@ -245,140 +484,514 @@ func (b *broker) GetServiceInstanceLastOperation(instanceID, serviceID, planID,
 // Implements the `CreateServiceInstance` interface method by creating (provisioning) a bucket.
 // Note: (nil, nil) is returned for success, meaning the CreateServiceInstanceResponse is ignored by
 //   the caller.
-func (b *broker) CreateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest) (*brokerapi.CreateServiceInstanceResponse, error) {
+func (b *broker) CreateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error) {
 	glog.Infof("CreateServiceInstance called.  instanceID: %s", instanceID)
-	b.rwMutex.Lock()
-	defer b.rwMutex.Unlock()
+	unlock, err := b.lock(b.instanceLockKeys(instanceID, req.ContextProfile.Namespace)...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	// does service instance exist?
 
-        _, err := b.findInstance(instanceID)
+        _, err = b.findInstance(instanceID)
 	if err == nil {
 		return nil, retErrInfof("Instance requested already exists.")
 	}
 
-	// Check required parameter "bucketName"
-	bucketName, ok := req.Parameters["bucketName"].(string)
-	if !ok {
-		glog.Errorf("Bucket name not provided, generating random name.")
-		bucketName = xid.New().String()
+	plan, err := findPlan(req.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateParams(b.createSchema(plan), req.Parameters); err != nil {
+		return nil, err
+	}
+
+	quota, err := b.checkCreatePolicy(req.ContextProfile.Namespace, plan, req.Parameters, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	rgw, err := b.selectBackend(plan, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if plan.sharedBucket {
+		return b.createSharedInstance(rgw, instanceID, plan, req, identity)
+	}
+
+	// The bucket name is optional, a random name is generated without it
+	bucketName := xid.New().String()
+	if val, ok := req.Parameters[BUCKET_NAME]; ok {
+		name, ok := val.(string)
+		if !ok {
+			return nil, retErrInfof("Error: parameter %q must be a string", BUCKET_NAME)
+		}
+		bucketName = name
+	} else {
+		glog.Infof("Bucket name not provided, generating random name.")
+	}
+
+	logicalNames, err := getBucketsParam(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	placement, err := b.selectPlacement(plan, req)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := parseBucketSettings(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := settings.checkObjectLock(plan.objectLock); err != nil {
+		return nil, err
+	}
+
+	notifications, err := b.parseNotifications(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	website, err := parseWebsite(plan, req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if website != nil {
+		if rgw.websiteEndpoint == "" {
+			return nil, retErrInfof("Error: no website endpoint configured for backend %q", rgw.backend)
+		}
+		if len(logicalNames) > 0 {
+			return nil, retErrInfof("Error: parameter %q is not supported by plan %q", BUCKETS, plan.name)
+		}
+	}
+
+	adoptInfo, err := b.checkAdoptBucket(rgw, req)
+	if err != nil {
+		return nil, err
+	}
+	if adoptInfo != nil && (plan.objectLock || plan.encryption != "" || plan.website) {
+		return nil, retErrInfof("Error: existing buckets can't be adopted by plan %q", plan.name)
+	}
+	if adoptInfo != nil && notifications != nil {
+		return nil, retErrInfof("Error: parameter %q can't be used when adopting a bucket", NOTIFICATIONS)
+	}
+	if adoptInfo != nil {
+		bucketName = adoptInfo.Data.Bucket.Name
+	} else {
+		bucketName = b.naming.expand(bucketName, req.ContextProfile.Namespace, instanceID)
+	}
+
+	// A single bucket is created unless a list of buckets was requested,
+	// in which case the bucket name is used as a common base name.
+	var buckets map[string]string
+	if len(logicalNames) > 0 {
+		buckets = make(map[string]string)
+		for _, name := range logicalNames {
+			buckets[name] = bucketName + "-" + name
+		}
+		bucketName = buckets[logicalNames[0]]
 	}
 	glog.Infof("Creating new bucket: %q for instance %q.", bucketName, instanceID)
 
+        instanceInfo := rgwServiceInstance{
+		Namespace: req.ContextProfile.Namespace,
+                BucketName: bucketName,
+		PlanID: plan.id,
+		Backend: rgw.backend,
+		Placement: placement,
+		ObjectLock: plan.objectLock,
+		Encryption: plan.encryption,
+		Buckets: buckets,
+		CreateParameters: createOnlyValues(req.Parameters),
+		CreatedBy: identity,
+		LastModifiedBy: identity,
+	}
+
+	// held until the buckets are created, so that concurrent provisions
+	// can't both find the same name available
+	unlockBuckets, err := b.lock(bucketLockKeys(instanceInfo.bucketNames())...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockBuckets()
+
+	if adoptInfo == nil {
+		if err := b.checkBucketNames(rgw, instanceInfo.bucketNames()); err != nil {
+			return nil, err
+		}
+	}
+
+	instanceInfo.KmsKeyID, err = b.prepareEncryption(instanceID, plan)
+	if err != nil {
+		return nil, err
+	}
+
 	// create new service instance
 
         userName := b.uidPrefix + xid.New().String()
+	unlockUser, err := b.lock(userLockKey(userName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlockUser()
 
         // First create a new user
-        newUser, err := b.rgw.provisionUser(userName, "rgw-broker-instance-" + instanceID, true, false)
+        newUser, err := rgw.provisionUser(userName, "rgw-broker-instance-" + instanceID, true, false)
         if err != nil {
                 return nil, err
         }
 
         newClient := RGWClient{
                 user: *newUser,
-                endpoint: b.rgw.endpoint,
-                zonegroup: b.rgw.zonegroup,
+                endpoint: rgw.endpoint,
+                zonegroup: rgw.zonegroup,
         }
+
+	// a failure past this point must not leave the user and its buckets
+	// behind
+	provisioned := false
+	defer func() {
+		if !provisioned {
+			b.rollbackInstance(rgw, &newClient, userName, &instanceInfo, adoptInfo)
+		}
+	}()
+
         err = newClient.init()
         if err != nil {
                 glog.Errorf("Failed to init s3 client for new user: %v", err)
 		return nil, fmt.Errorf("Failed to init s3 client for new user: %v", err)
         }
 
-	if err := newClient.createBucket(bucketName); err != nil {
+        instanceInfo.Endpoint = newClient.endpoint
+        instanceInfo.UserName = newUser.name
+        instanceInfo.ProvisioningKey = newUser.accessKey
+
+	if err := rgw.setUserPlacement(userName, placement); err != nil {
 		return nil, err
 	}
 
-	if err := b.rgw.modifyUser(userName, "max-buckets", "-1"); err != nil {
+	if quota > 0 {
+		if err := rgw.setUserQuota(userName, quota); err != nil {
+			return nil, err
+		}
+		instanceInfo.QuotaBytes = quota
+	}
+
+	if adoptInfo != nil {
+		if err := adoptBucket(rgw, adoptInfo, userName); err != nil {
+			return nil, err
+		}
+		instanceInfo.AdoptedFrom = adoptInfo.Data.Owner
+	} else {
+		for _, name := range instanceInfo.bucketNames() {
+			opts := bucketOptions{
+				placement:  placement.Placement,
+				objectLock: plan.objectLock,
+			}
+			if err := newClient.createBucket(name, opts); err != nil {
+				return nil, err
+			}
+			if plan.encryption == "" {
+				continue
+			}
+			if err := newClient.setBucketEncryption(name, plan.encryption, instanceInfo.KmsKeyID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if adoptInfo == nil {
+		// adopted buckets keep their configuration unless asked otherwise
+		settings.withPlanDefaults(plan)
+	}
+
+	if err := settings.apply(&newClient, &instanceInfo); err != nil {
 		return nil, err
 	}
 
-        instanceInfo := rgwServiceInstance{
-		Namespace: req.ContextProfile.Namespace,
-                Endpoint: newClient.endpoint,
-                UserName: newUser.name,
-                BucketName: bucketName,
+	if website != nil {
+		if err := newClient.setBucketWebsite(instanceInfo.BucketName, website); err != nil {
+			return nil, err
+		}
+		instanceInfo.WebsiteEndpoint = rgw.websiteURL(instanceInfo.BucketName)
+	}
+
+	if notifications != nil {
+		instanceInfo.TopicArn, err = rgw.createTopic(topicName(instanceID), notifications)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range instanceInfo.bucketNames() {
+			if err := newClient.setBucketNotification(name, instanceInfo.TopicArn, notifications); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := rgw.modifyUser(userName, "max-buckets", "-1"); err != nil {
+		return nil, err
 	}
 
         err = b.storeInstanceInfo(instanceID, instanceInfo)
         if (err != nil) {
                 return nil, retErrInfof("Error: failed to store instance info: %s", err)
         }
+	provisioned = true
+	b.updateNamespaceUsage(instanceInfo.Namespace, namespaceUsage{Instances: 1, QuotaBytes: instanceInfo.QuotaBytes})
 
-	b.instanceMap[instanceID] = &instanceInfo
+	b.cacheInstance(instanceID, &instanceInfo)
 
-	return nil, nil
+	return &brokerapi.CreateServiceInstanceResponse{
+		DashboardURL: b.dashboardURL(instanceID),
+	}, nil
 }
 
 // Implements the `RemoveServiceInstance` interface method.
-func (b *broker) RemoveServiceInstance(instanceID, serviceID, planID string, acceptsIncomplete bool) (*brokerapi.DeleteServiceInstanceResponse, error) {
+func (b *broker) RemoveServiceInstance(instanceID, serviceID, planID string, acceptsIncomplete bool, identity *OriginatingIdentity) (*brokerapi.DeleteServiceInstanceResponse, error) {
 	glog.Infof("RemoveServiceInstance called. instanceID: %s", instanceID)
-	b.rwMutex.Lock()
-	defer b.rwMutex.Unlock()
+	// the namespace of the instance is needed to pick the locks, the record
+	// is read again once locked in case the instance was removed meanwhile
         instance, err := b.findInstance(instanceID)
 	if err != nil {
                 glog.Errorf("InstanceID %q not found.", instanceID)
                 /* don't return error, if it wasn't found it was already removed */
                 return nil, nil
 	}
+	unlock, err := b.lock(b.instanceLockKeys(instanceID, instance.Namespace)...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	instance, err = b.findInstance(instanceID)
+	if err != nil {
+		glog.Errorf("InstanceID %q not found.", instanceID)
+		return nil, nil
+	}
 
-        userName := instance.UserName
-        bucketName := instance.BucketName
+        if instance.Prefix != "" {
+                if err := b.removeSharedInstance(instanceID, instance); err != nil {
+                        return nil, err
+                }
+        } else if err := b.removeBucketInstance(instanceID, instance); err != nil {
+                return nil, err
+        }
 
-        err = b.rgw.suspendUser(userName)
+        err = b.removeInstanceInfo(instanceID)
 	if err != nil {
-		glog.Errorf("Error failed to suspend user: %v", err)
-		return nil, fmt.Errorf("Error failed to suspend user: %v", err)
+		glog.Infof("Warning: failed to clean instance info: instanceID=%s: %s", instanceID, err)
+		b.resetNamespaceUsage(instance.Namespace)
+	} else if bindings, err := b.countBindings(instanceID); err != nil {
+		glog.Errorf("Warning: failed to count the bindings of instance %s: %v", instanceID, err)
+		b.resetNamespaceUsage(instance.Namespace)
+	} else {
+		// binding records left behind no longer count for the namespace
+		b.updateNamespaceUsage(instance.Namespace, namespaceUsage{Instances: -1, Bindings: -bindings, QuotaBytes: -instance.QuotaBytes})
 	}
 
-        var status int
+	b.forgetInstance(instanceID)
+	glog.Infof("Remove instance %q succeeded.", instanceID)
+	return nil, nil
+}
 
-        bucketId, err := b.rgw.getBucketId(bucketName, &status)
-        if status != http.StatusNotFound {
-                if err != nil {
-                        return nil, fmt.Errorf("Error failed to retrieve bucket id for bucket %q: %v", bucketName, err)
-                }
+// Removes an instance that owns its buckets. The buckets are parked under the gc
+// user and the instance user is removed. For Object Lock enabled buckets a
+// record is kept of how long their objects may stay under retention, so that
+// they are not purged before that.
+func (b *broker) removeBucketInstance(instanceID string, instance *rgwServiceInstance) error {
+        rgw, err := b.instanceBackend(instance)
+        if err != nil {
+                return err
+        }
 
-                glog.Infof("bucketId: %s", bucketId)
+        userName := instance.UserName
 
-                err = b.rgw.unlinkBucket(userName, bucketName)
-                if err != nil {
-                        return nil, fmt.Errorf("Error failed to unlink bucket %s/%s: %v", userName, bucketName, err)
-                }
+	// a bucket still under a retention record may only go back under the gc
+	// user with its record, checked before anything is changed
+	newOwner := b.returnOwner(rgw, instance)
+	for _, bucketName := range instance.bucketNames() {
+		if instance.ObjectLock && newOwner == b.gcUser {
+			continue
+		}
+		if err := b.checkPurgeAllowed(instance.Backend, bucketName); err != nil {
+			return err
+		}
+	}
 
-                err = b.rgw.linkBucket(b.gcUser, bucketName, bucketId)
-                if err != nil {
-                        return nil, fmt.Errorf("Error failed to unlink bucket %s/%s: %v", userName, bucketName, err)
+        user, err := rgw.getUserInfo(userName)
+        if err != nil {
+                return err
+        }
+
+        // the user must not be suspended yet, so that it can still access
+        // its buckets. A suspended user means that a previous attempt got
+        // past this point already.
+        if user.Suspended == 0 {
+                // a parked bucket must not stay public
+                if err := b.closeWebsite(rgw, instance); err != nil {
+                        return err
                 }
 
-                err = b.rgw.removeUser(userName)
+                // best effort, a failure must not prevent the removal of
+                // the instance
+                err = b.cleanupBucketSettings(rgw, instance)
                 if err != nil {
-                        return nil, fmt.Errorf("Error failed to unlink bucket %s/%s: %v", userName, bucketName, err)
+                        glog.Errorf("Warning: failed to clean up bucket settings of user %s: %v", userName, err)
                 }
         }
 
-        err = b.removeInstanceInfo(instanceID)
+	if instance.TopicArn != "" {
+		// an orphan topic must not prevent the removal of the instance
+		if err := rgw.deleteTopic(instance.TopicArn); err != nil {
+			glog.Errorf("Warning: failed to remove topic of instance %s: %v", instanceID, err)
+		}
+	}
+
+        err = rgw.suspendUser(userName)
+	if err != nil {
+		glog.Errorf("Error failed to suspend user: %v", err)
+		return fmt.Errorf("Error failed to suspend user: %v", err)
+	}
+
+	for _, bucketName := range instance.bucketNames() {
+		if instance.ObjectLock && newOwner == b.gcUser {
+			if err := b.storeParkedBucket(instanceID, instance, bucketName); err != nil {
+				return err
+			}
+		}
+		if err := moveBucket(rgw, userName, bucketName, newOwner); err != nil {
+			return err
+		}
+	}
+
+        err = rgw.removeUser(userName)
         if err != nil {
-                glog.Infof("Warning: failed to clean instance info: instanceID=%s: %s", instanceID, err)
+                return fmt.Errorf("Error failed to remove user %s: %v", userName, err)
         }
+        return nil
+}
 
-	delete(b.instanceMap, BUCKET_NAME)
-	glog.Infof("Remove bucket %q succeeded.", bucketName)
-	return nil, nil
+// Undoes a provision that failed after its user was created: the topic is
+// removed, the buckets created for the instance are deleted while still empty,
+// an adopted bucket goes back to its owner, and the user is removed. Failures
+// are only logged, the orphan scanner reports whatever is left.
+func (b *broker) rollbackInstance(rgw, client *RGWClient, userName string, instance *rgwServiceInstance, adoptInfo *bucketEntrypointInfo) {
+	glog.Infof("Rolling back the provision of user %s", userName)
+
+	if instance.TopicArn != "" {
+		if err := rgw.deleteTopic(instance.TopicArn); err != nil {
+			glog.Errorf("Warning: failed to remove topic %s: %v", instance.TopicArn, err)
+		}
+	}
+
+	if adoptInfo != nil {
+		if err := moveBucket(rgw, userName, adoptInfo.Data.Bucket.Name, adoptInfo.Data.Owner); err != nil {
+			glog.Errorf("Warning: failed to return bucket %s to %s: %v", adoptInfo.Data.Bucket.Name, adoptInfo.Data.Owner, err)
+		}
+	} else if client.client != nil {
+		for _, name := range instance.bucketNames() {
+			if err := client.deleteBucket(name); err != nil {
+				glog.Errorf("Warning: failed to delete bucket %s: %v", name, err)
+			}
+		}
+	}
+
+	if err := rgw.removeUser(userName); err != nil {
+		glog.Errorf("Warning: failed to remove user %s: %v", userName, err)
+	}
+}
+
+// Relinks the bucket from userName to newOwner, which is either the gc user, so
+// that the bucket can later be destroyed, or the original owner of an adopted
+// bucket. A bucket that no longer exists is skipped.
+func moveBucket(rgw *RGWClient, userName, bucketName, newOwner string) error {
+        var status int
+
+        bucketId, err := rgw.getBucketId(bucketName, &status)
+        if status == http.StatusNotFound {
+                glog.Infof("Bucket %q not found, skipping", bucketName)
+                return nil
+        }
+        if err != nil {
+                return fmt.Errorf("Error failed to retrieve bucket id for bucket %q: %v", bucketName, err)
+        }
+
+        glog.Infof("bucketId: %s", bucketId)
+
+        err = rgw.unlinkBucket(userName, bucketName)
+        if err != nil {
+                return fmt.Errorf("Error failed to unlink bucket %s/%s: %v", userName, bucketName, err)
+        }
+
+        err = rgw.linkBucket(newOwner, bucketName, bucketId)
+        if err != nil {
+                return fmt.Errorf("Error failed to link bucket %s/%s: %v", newOwner, bucketName, err)
+        }
+        return nil
+}
+
+// Returns the logical bucket names requested through the optional "buckets"
+// parameter.
+func getBucketsParam(params map[string]interface{}) ([]string, error) {
+	val, ok := params[BUCKETS]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, retErrInfof("Error: parameter %q must be a list of names", BUCKETS)
+	}
+	names := make([]string, 0, len(list))
+	seen := make(map[string]bool)
+	for _, v := range list {
+		name, ok := v.(string)
+		if !ok || name == "" {
+			return nil, retErrInfof("Error: parameter %q must be a list of names", BUCKETS)
+		}
+		if seen[name] {
+			return nil, retErrInfof("Error: bucket %q requested more than once", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
 }
 
 // Implements the `Bind` interface method.
-func (b *broker) Bind(instanceID, bindingID string, req *brokerapi.BindingRequest) (*brokerapi.CreateServiceBindingResponse, error) {
+func (b *broker) Bind(instanceID, bindingID string, req *brokerapi.BindingRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceBindingResponse, error) {
 	glog.Infof("Bind called. instanceID: %q", instanceID)
+	// the namespace of the instance is needed to pick the locks, the record
+	// is read again once locked in case the instance was removed meanwhile
         instance, err := b.findInstance(instanceID)
 	if err != nil {
 		return nil, fmt.Errorf("Instance ID %q not found.", instanceID)
 	}
+	unlock, err := b.lock(b.instanceLockKeys(instanceID, instance.Namespace)...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	instance, err = b.findInstance(instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("Instance ID %q not found.", instanceID)
+	}
 
 	if instance.UserName == "" {
 		return nil, retErrInfof("No user found for instance %q.", instanceID)
 	}
 
+	plan, err := findPlan(instance.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateParams(b.bindSchema(plan), req.Parameters); err != nil {
+		return nil, err
+	}
+
         oldInfo, err := b.getBindInfo(instanceID, bindingID)
         if err == nil {
                 glog.Infof("Bind ID already exists, returning existing info")
@@ -387,7 +1000,16 @@ func (b *broker) Bind(instanceID, bindingID string, req *brokerapi.BindingReques
                 }, nil
         }
 
-        key, err := b.rgw.createKey(instance.UserName)
+	if err := b.checkBindPolicy(instance.Namespace, identity); err != nil {
+		return nil, err
+	}
+
+        rgw, err := b.instanceBackend(instance)
+        if err != nil {
+                return nil, err
+        }
+
+        key, err := rgw.createKey(instance.UserName)
         if err != nil {
                 return nil, retErrInfof("Error: failed to create access key: %s", err)
         }
@@ -398,13 +1020,30 @@ func (b *broker) Bind(instanceID, bindingID string, req *brokerapi.BindingReques
                 ACCESS_KEY:      key.accessKey,
                 SECRET_KEY:      key.secret,
         }
+	if len(instance.Buckets) > 0 {
+		creds[BUCKETS] = instance.Buckets
+	}
+	if instance.Prefix != "" {
+		creds[PREFIX] = instance.Prefix
+	}
+	if instance.WebsiteEndpoint != "" {
+		creds[WEBSITE_ENDPOINT] = instance.WebsiteEndpoint
+	}
 
         bInfo := rgwBindInfo {
                 Credential: creds,
+                CreatedBy: identity,
         }
 
-        err = b.storeBindInfo(instanceID, bindingID, bInfo)
-
+	if err := b.storeBindInfo(instanceID, bindingID, bInfo); err != nil {
+		// a key no binding record holds would only be found by the orphan
+		// scanner
+		if rerr := rgw.removeKey(instance.UserName, key.accessKey); rerr != nil {
+			glog.Errorf("Warning: failed to remove access key %s of user %s: %v", key.accessKey, instance.UserName, rerr)
+		}
+		return nil, retErrInfof("Error: failed to store binding info: %s", err)
+	}
+	b.updateNamespaceUsage(instance.Namespace, namespaceUsage{Bindings: 1})
 
 	glog.Infof("Bind instance %q succeeded.", instanceID)
 	return &brokerapi.CreateServiceBindingResponse{
@@ -414,14 +1053,25 @@ func (b *broker) Bind(instanceID, bindingID string, req *brokerapi.BindingReques
 
 // nothing to do here
 // The `UnBind` interface method is not implemented.
-func (b *broker) UnBind(instanceID, bindingID, serviceID, planID string) error {
-        glog.Infof("Bind called. instanceID: %q, bindingID: %q", instanceID, bindingID)
+func (b *broker) UnBind(instanceID, bindingID, serviceID, planID string, identity *OriginatingIdentity) error {
+        glog.Infof("UnBind called. instanceID: %q, bindingID: %q", instanceID, bindingID)
+	// locks the same keys as Bind, the record is read again once locked
         instance, err := b.findInstance(instanceID)
 	if err != nil {
 		glog.Infof("Instance ID %q not found.", instanceID)
                 /* don't return error */
 		return nil
 	}
+	unlock, err := b.lock(b.instanceLockKeys(instanceID, instance.Namespace)...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	instance, err = b.findInstance(instanceID)
+	if err != nil {
+		glog.Infof("Instance ID %q not found.", instanceID)
+		return nil
+	}
 
 
         oldInfo, err := b.getBindInfo(instanceID, bindingID)
@@ -430,7 +1080,12 @@ func (b *broker) UnBind(instanceID, bindingID, serviceID, planID string) error {
                 return nil
         }
 
-        err = b.rgw.removeKey(instance.UserName, oldInfo.Credential[ACCESS_KEY].(string))
+        rgw, err := b.instanceBackend(instance)
+        if err != nil {
+                return err
+        }
+
+        err = rgw.removeKey(instance.UserName, oldInfo.Credential[ACCESS_KEY].(string))
         if err != nil {
                 glog.Infof("Failed to remove access key")
                 return err
@@ -441,6 +1096,7 @@ func (b *broker) UnBind(instanceID, bindingID, serviceID, planID string) error {
                 glog.Infof("Failed to remove binding info")
                 return nil
         }
+	b.updateNamespaceUsage(instance.Namespace, namespaceUsage{Bindings: -1})
 	return nil
 }
 
@@ -549,7 +1205,8 @@ func (rgw *RGWClient) rgwAdminRequestRaw(method, section, resource string, param
 	}
 
         token := ""
-        s := v4.NewSigner(credentials.NewStaticCredentials(rgw.user.accessKey, rgw.user.secret, token))
+        user, _ := rgw.credentials()
+        s := v4.NewSigner(credentials.NewStaticCredentials(user.accessKey, user.secret, token))
 
         _, err = s.Sign(req, nil, "s3", "default", time.Now())
 	if req.Header.Get("Authorization") == "" {
@@ -594,6 +1251,7 @@ func (rgw *RGWClient) rgwAdminRequest(method, section, resource string, params u
 
 type userInfo struct {
         UserId  string    `json:"user_id"`
+        Suspended int     `json:"suspended"`
         Keys    []struct {
                 AccessKey string  `json:"access_key"`
                 Secret string     `json:"secret_key"`
@@ -683,32 +1341,42 @@ func (rgw *RGWClient) modifyUser(userName, param, val string) error {
         return nil
 }
 
-func (rgw *RGWClient) getBucketId(bucketName string, status *int) (string, error) {
-	glog.Infof("Getting bucket-id for buceket=%q", bucketName)
+type bucketEntrypointInfo struct {
+        Data struct {
+                Bucket  struct {
+                        Name string     `json:"name"`
+                        Marker string   `json:"marker"`
+                        BucketId string `json:"bucket_id"`
+                } `json:"bucket"`
+                Owner string            `json:"owner"`
+        } `json:"data"`
+}
 
+func (rgw *RGWClient) getBucketEntrypoint(bucketName string, status *int) (*bucketEntrypointInfo, error) {
 	// Set request parameters.
 	params := make(url.Values)
         params.Set("key", "bucket:" + bucketName)
 
         body, err := rgw.rgwAdminRequest("GET", "metadata", "", params, status)
 	if err != nil {
-                return "", retErrInfof("Error fetching bucket metadata info: %v", err)
+                return nil, retErrInfof("Error fetching bucket metadata info: %v", err)
 	}
 
-        type bucketEntrypointInfo struct {
-                Data struct {
-                        Bucket  struct {
-                                Name string     `json:"name"`
-                                Marker string   `json:"marker"`
-                                BucketId string `json:"bucket_id"`
-                        } `json:"bucket"`
-                } `json:"data"`
+        res := new(bucketEntrypointInfo)
+        err = json.Unmarshal(body, res)
+        if (err != nil) {
+                return nil, retErrInfof("Error failed to unmarshal bucket entrypoint info: %v", err)
         }
 
-        res := bucketEntrypointInfo{}
-        err = json.Unmarshal(body, &res)
-        if (err != nil) {
-                return "", retErrInfof("Error failed to unmarshal bucket entrypoint info: %v", err)
+        return res, nil
+}
+
+func (rgw *RGWClient) getBucketId(bucketName string, status *int) (string, error) {
+	glog.Infof("Getting bucket-id for buceket=%q", bucketName)
+
+        res, err := rgw.getBucketEntrypoint(bucketName, status)
+        if err != nil {
+                return "", err
         }
 
         glog.Infof("retrieved bucket_id=%s)", res.Data.Bucket.BucketId)
@@ -873,8 +1541,8 @@ func (rgw *RGWClient) removeKey(userName, accessKey string) error {
 
 
 // Returns a S3 api client.
-func getS3Client(user RGWUser, endpoint, region string) (*s3.S3, error) {
-        glog.Infof("Creating s3 client based on: \"%s\" on endpoint %s (%s)", user.accessKey, endpoint, region)
+func getS3Client(accessKey string, creds *credentials.Credentials, endpoint, region string) (*s3.S3, error) {
+        glog.Infof("Creating s3 client based on: \"%s\" on endpoint %s (%s)", accessKey, endpoint, region)
 
         addr := endpoint
         noSSL := false
@@ -888,8 +1556,6 @@ func getS3Client(user RGWUser, endpoint, region string) (*s3.S3, error) {
 
 
         pathStyle := true
-        token := ""
-        creds := credentials.NewStaticCredentials(user.accessKey, user.secret, token)
         sess, err := session.NewSessionWithOptions(session.Options{
                 Config: aws.Config{
                         Region: &region,
@@ -929,6 +1595,6 @@ func getKubeClient() (*clientset.Clientset, error) {
 
 
 func retErrInfof(format string, args ...interface{}) error {
-        glog.Infof(format, args)
-        return fmt.Errorf(format, args)
+        glog.Infof(format, args...)
+        return fmt.Errorf(format, args...)
 }
@@ -17,6 +17,8 @@ limitations under the License.
 package broker
 
 import (
+	"time"
+
 	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
 )
 
@@ -26,9 +28,24 @@ type Broker interface {
 	Catalog() (*brokerapi.Catalog, error)
 
 	GetServiceInstanceLastOperation(instanceID, serviceID, planID, operation string) (*brokerapi.LastOperationResponse, error)
-	CreateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest) (*brokerapi.CreateServiceInstanceResponse, error)
-	RemoveServiceInstance(instanceID, serviceID, planID string, acceptsIncomplete bool) (*brokerapi.DeleteServiceInstanceResponse, error)
-
-	Bind(instanceID, bindingID string, req *brokerapi.BindingRequest) (*brokerapi.CreateServiceBindingResponse, error)
-	UnBind(instanceID, bindingID, serviceID, planID string) error
+	// The identity of the platform user behind the request is nil when the
+	// platform didn't send it.
+	CreateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error)
+	UpdateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error)
+	RemoveServiceInstance(instanceID, serviceID, planID string, acceptsIncomplete bool, identity *OriginatingIdentity) (*brokerapi.DeleteServiceInstanceResponse, error)
+
+	Bind(instanceID, bindingID string, req *brokerapi.BindingRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceBindingResponse, error)
+	UnBind(instanceID, bindingID, serviceID, planID string, identity *OriginatingIdentity) error
+
+	// Available to platforms using version 2.14 of the API.
+	GetServiceInstance(instanceID string) (*GetServiceInstanceResponse, error)
+	GetServiceBinding(instanceID, bindingID string) (*GetServiceBindingResponse, error)
+
+	InstanceUsage(instanceID string, start, end time.Time) (*InstanceUsage, error)
+	NamespaceUsage(namespace string, start, end time.Time) (*NamespaceUsage, error)
+	Chargeback(start, end time.Time) (*ChargebackReport, error)
+
+	// Looks for RGW users, keys and buckets the broker no longer tracks, and
+	// applies the action to the ones older than minAge.
+	ScanOrphans(action string, minAge time.Duration) (*OrphanReport, error)
 }
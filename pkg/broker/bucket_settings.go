@@ -0,0 +1,226 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	VERSIONING = "versioning"
+
+	VERSIONING_ENABLED   = "enabled"
+	VERSIONING_SUSPENDED = "suspended"
+)
+
+// bucketSettings holds the bucket configuration requested through instance
+// parameters. It is applied to every bucket of the instance, both when the
+// instance is created and when it is updated. Nil fields are left unchanged.
+type bucketSettings struct {
+	versioning *string
+	// an empty list removes the lifecycle configuration
+	lifecycle *[]lifecycleRule
+	// an empty list removes the CORS configuration
+	cors *[]corsRule
+	// only for Object Lock enabled buckets
+	retention *objectRetention
+}
+
+// Parses and validates the bucket configuration parameters.
+func parseBucketSettings(params map[string]interface{}) (*bucketSettings, error) {
+	s := &bucketSettings{}
+
+	if val, ok := params[VERSIONING]; ok {
+		v, ok := val.(string)
+		if !ok || (v != VERSIONING_ENABLED && v != VERSIONING_SUSPENDED) {
+			return nil, retErrInfof("Error: parameter %q must be %q or %q", VERSIONING, VERSIONING_ENABLED, VERSIONING_SUSPENDED)
+		}
+		s.versioning = &v
+	}
+
+	if val, ok := params[LIFECYCLE]; ok {
+		rules, err := parseLifecycle(val)
+		if err != nil {
+			return nil, err
+		}
+		s.lifecycle = &rules
+	}
+
+	if val, ok := params[CORS]; ok {
+		rules, err := parseCors(val)
+		if err != nil {
+			return nil, err
+		}
+		s.cors = &rules
+	}
+
+	if val, ok := params[RETENTION]; ok {
+		r, err := parseRetention(val)
+		if err != nil {
+			return nil, err
+		}
+		s.retention = r
+	}
+
+	return s, nil
+}
+
+// Fills in the plan defaults for the settings that were not requested.
+func (s *bucketSettings) withPlanDefaults(plan *rgwPlan) {
+	if s.lifecycle == nil && plan.lifecycle != nil {
+		rules := plan.lifecycle
+		s.lifecycle = &rules
+	}
+	if s.retention == nil && plan.retention != nil {
+		r := *plan.retention
+		s.retention = &r
+	}
+}
+
+// Checks that the settings fit buckets with or without Object Lock.
+func (s *bucketSettings) checkObjectLock(objectLock bool) error {
+	if !objectLock && s.retention != nil {
+		return retErrInfof("Error: parameter %q needs a plan with Object Lock enabled", RETENTION)
+	}
+	if objectLock && s.versioning != nil && *s.versioning != VERSIONING_ENABLED {
+		return retErrInfof("Error: versioning can't be suspended on Object Lock enabled buckets")
+	}
+	return nil
+}
+
+// Applies the settings to the instance buckets using the bucket owner's client,
+// and records them in the instance info.
+func (s *bucketSettings) apply(c *RGWClient, instance *rgwServiceInstance) error {
+	for _, bucketName := range instance.bucketNames() {
+		if s.versioning != nil {
+			if err := c.setBucketVersioning(bucketName, *s.versioning); err != nil {
+				return err
+			}
+		}
+		if s.lifecycle != nil {
+			if err := c.setBucketLifecycle(bucketName, *s.lifecycle); err != nil {
+				return err
+			}
+		}
+		if s.cors != nil {
+			if err := c.setBucketCors(bucketName, *s.cors); err != nil {
+				return err
+			}
+		}
+		if s.retention != nil {
+			if err := c.setBucketRetention(bucketName, s.retention); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.versioning != nil {
+		instance.Versioning = *s.versioning
+	}
+	if s.lifecycle != nil {
+		instance.Lifecycle = *s.lifecycle
+	}
+	if s.cors != nil {
+		instance.Cors = *s.cors
+	}
+	if s.retention != nil {
+		// objects keep the retention they were written under
+		if longest := instance.longestRetention(); longest == nil || s.retention.period() > longest.period() {
+			instance.LongestRetention = s.retention
+		} else {
+			instance.LongestRetention = longest
+		}
+		instance.Retention = s.retention
+	}
+	return nil
+}
+
+func (c *RGWClient) setBucketVersioning(bucketName, versioning string) error {
+	glog.Infof("Setting versioning of bucket %q to %s", bucketName, versioning)
+
+	status := s3.BucketVersioningStatusSuspended
+	if versioning == VERSIONING_ENABLED {
+		status = s3.BucketVersioningStatusEnabled
+	}
+
+	_, err := c.client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: &bucketName,
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(status),
+		},
+	})
+	if err != nil {
+		return retErrInfof("Error setting versioning of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+// Removes the bucket settings that must not outlive the instance, before its
+// buckets are parked or returned to their original owner.
+func (b *broker) cleanupBucketSettings(rgw *RGWClient, instance *rgwServiceInstance) error {
+	if len(instance.Cors) == 0 && instance.TopicArn == "" {
+		return nil
+	}
+
+	client, cleanup, err := instanceClient(rgw, instance)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if instance.TopicArn != "" {
+		for _, bucketName := range instance.bucketNames() {
+			if err := client.setBucketNotification(bucketName, "", nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(instance.Cors) == 0 {
+		return nil
+	}
+	settings := &bucketSettings{cors: &[]corsRule{}}
+	return settings.apply(client, instance)
+}
+
+// Returns a client acting as the instance user, which owns the instance
+// buckets. A temporary access key is created for it, and removed when the
+// returned cleanup function is called.
+func instanceClient(rgw *RGWClient, instance *rgwServiceInstance) (*RGWClient, func(), error) {
+	key, err := rgw.createKey(instance.UserName)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		if err := rgw.removeKey(instance.UserName, key.accessKey); err != nil {
+			glog.Errorf("Failed to remove temporary access key of user %s: %v", instance.UserName, err)
+		}
+	}
+
+	c := &RGWClient{
+		user:      *key,
+		endpoint:  rgw.endpoint,
+		zonegroup: rgw.zonegroup,
+	}
+	if err := c.init(); err != nil {
+		cleanup()
+		return nil, nil, retErrInfof("Failed to init s3 client for user %s: %v", instance.UserName, err)
+	}
+	return c, cleanup, nil
+}
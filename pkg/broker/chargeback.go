@@ -0,0 +1,211 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	CHARGEBACK_CSV   = "csv"
+	CHARGEBACK_JSONL = "jsonl"
+
+	// aggregation levels of the chargeback rows
+	CHARGEBACK_INSTANCE  = "instance"
+	CHARGEBACK_PLAN      = "plan"
+	CHARGEBACK_NAMESPACE = "namespace"
+)
+
+// ChargebackRow is the usage of an instance, or the total of a plan within a
+// namespace, or of a namespace, depending on its level.
+type ChargebackRow struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Level         string    `json:"level"`
+	Namespace     string    `json:"namespace"`
+	Plan          string    `json:"plan,omitempty"`
+	InstanceID    string    `json:"instanceId,omitempty"`
+	SizeBytes     int64     `json:"sizeBytes"`
+	Objects       int64     `json:"objects"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+	Ops           int64     `json:"ops"`
+}
+
+func (r *ChargebackRow) add(o *ChargebackRow) {
+	r.SizeBytes += o.SizeBytes
+	r.Objects += o.Objects
+	r.BytesSent += o.BytesSent
+	r.BytesReceived += o.BytesReceived
+	r.Ops += o.Ops
+}
+
+// ChargebackReport holds the rows of a chargeback report, sorted by namespace,
+// plan and instance, each namespace and plan followed by its total.
+type ChargebackReport struct {
+	Rows []ChargebackRow
+}
+
+// Implements the `Chargeback` interface method. The traffic comes from the
+// RGW usage log over the time range, while the stored bytes and objects are
+// the current ones. A zero start selects the beginning of the current month,
+// and a zero end the current time. Removed instances are not reported.
+func (b *broker) Chargeback(start, end time.Time) (*ChargebackReport, error) {
+	now := time.Now().UTC()
+	if start.IsZero() {
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	if end.IsZero() {
+		end = now
+	}
+	if !start.Before(end) {
+		return nil, retErrInfof("Error: chargeback start %v must be before end %v", start, end)
+	}
+	glog.Infof("Chargeback called. start: %v end: %v", start, end)
+
+	instances, err := b.listInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []ChargebackRow
+	for _, id := range sortedInstanceIDs(instances) {
+		instance := instances[id]
+		u, err := b.instanceUsage(id, instance, start, end)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, ChargebackRow{
+			Level:         CHARGEBACK_INSTANCE,
+			Namespace:     instance.Namespace,
+			Plan:          planName(instance.PlanID),
+			InstanceID:    id,
+			SizeBytes:     u.SizeBytes,
+			Objects:       u.Objects,
+			BytesSent:     u.Traffic.BytesSent,
+			BytesReceived: u.Traffic.BytesReceived,
+			Ops:           u.Traffic.Ops,
+		})
+	}
+
+	report := &ChargebackReport{Rows: aggregateChargeback(rows)}
+	for i := range report.Rows {
+		report.Rows[i].Start = start
+		report.Rows[i].End = end
+	}
+	return report, nil
+}
+
+// Returns the name of the plan, or its id if it isn't offered anymore.
+func planName(planID string) string {
+	plan, err := findPlan(planID)
+	if err != nil {
+		return planID
+	}
+	return plan.name
+}
+
+// Sorts the instance rows and adds the plan and namespace totals after them.
+func aggregateChargeback(rows []ChargebackRow) []ChargebackRow {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Namespace != rows[j].Namespace {
+			return rows[i].Namespace < rows[j].Namespace
+		}
+		return rows[i].Plan < rows[j].Plan
+	})
+
+	var out []ChargebackRow
+	var plan, namespace *ChargebackRow
+	flush := func(all bool) {
+		if plan != nil {
+			out = append(out, *plan)
+			plan = nil
+		}
+		if all && namespace != nil {
+			out = append(out, *namespace)
+			namespace = nil
+		}
+	}
+	for i := range rows {
+		r := &rows[i]
+		if namespace != nil && namespace.Namespace != r.Namespace {
+			flush(true)
+		} else if plan != nil && plan.Plan != r.Plan {
+			flush(false)
+		}
+		if namespace == nil {
+			namespace = &ChargebackRow{Level: CHARGEBACK_NAMESPACE, Namespace: r.Namespace}
+		}
+		if plan == nil {
+			plan = &ChargebackRow{Level: CHARGEBACK_PLAN, Namespace: r.Namespace, Plan: r.Plan}
+		}
+		out = append(out, *r)
+		plan.add(r)
+		namespace.add(r)
+	}
+	flush(true)
+	return out
+}
+
+// Writes the report in the given format, CHARGEBACK_CSV or CHARGEBACK_JSONL.
+func (r *ChargebackReport) Write(w io.Writer, format string) error {
+	switch format {
+	case CHARGEBACK_CSV:
+		return r.writeCSV(w)
+	case CHARGEBACK_JSONL:
+		enc := json.NewEncoder(w)
+		for i := range r.Rows {
+			if err := enc.Encode(&r.Rows[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid chargeback format %q, expected %q or %q", format, CHARGEBACK_CSV, CHARGEBACK_JSONL)
+	}
+}
+
+func (r *ChargebackReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"start", "end", "level", "namespace", "plan", "instance_id",
+		"size_bytes", "objects", "bytes_sent", "bytes_received", "ops"})
+	for _, row := range r.Rows {
+		cw.Write([]string{
+			row.Start.Format(time.RFC3339),
+			row.End.Format(time.RFC3339),
+			row.Level,
+			row.Namespace,
+			row.Plan,
+			row.InstanceID,
+			strconv.FormatInt(row.SizeBytes, 10),
+			strconv.FormatInt(row.Objects, 10),
+			strconv.FormatInt(row.BytesSent, 10),
+			strconv.FormatInt(row.BytesReceived, 10),
+			strconv.FormatInt(row.Ops, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAggregateChargeback(t *testing.T) {
+	instance := func(namespace, plan, id string, size int64) ChargebackRow {
+		return ChargebackRow{Level: CHARGEBACK_INSTANCE, Namespace: namespace, Plan: plan, InstanceID: id, SizeBytes: size, Ops: 1}
+	}
+	planTotal := func(namespace, plan string, size, ops int64) ChargebackRow {
+		return ChargebackRow{Level: CHARGEBACK_PLAN, Namespace: namespace, Plan: plan, SizeBytes: size, Ops: ops}
+	}
+	namespaceTotal := func(namespace string, size, ops int64) ChargebackRow {
+		return ChargebackRow{Level: CHARGEBACK_NAMESPACE, Namespace: namespace, SizeBytes: size, Ops: ops}
+	}
+
+	tests := []struct {
+		name string
+		rows []ChargebackRow
+		want []ChargebackRow
+	}{
+		{
+			name: "no rows",
+			rows: nil,
+			want: nil,
+		},
+		{
+			name: "single instance",
+			rows: []ChargebackRow{instance("a", "default", "i1", 10)},
+			want: []ChargebackRow{
+				instance("a", "default", "i1", 10),
+				planTotal("a", "default", 10, 1),
+				namespaceTotal("a", 10, 1),
+			},
+		},
+		{
+			name: "plans and namespaces are sorted and totalled",
+			rows: []ChargebackRow{
+				instance("b", "default", "i1", 1),
+				instance("a", "website", "i2", 2),
+				instance("a", "default", "i3", 4),
+				instance("a", "website", "i4", 8),
+			},
+			want: []ChargebackRow{
+				instance("a", "default", "i3", 4),
+				planTotal("a", "default", 4, 1),
+				instance("a", "website", "i2", 2),
+				instance("a", "website", "i4", 8),
+				planTotal("a", "website", 10, 2),
+				namespaceTotal("a", 14, 3),
+				instance("b", "default", "i1", 1),
+				planTotal("b", "default", 1, 1),
+				namespaceTotal("b", 1, 1),
+			},
+		},
+		{
+			name: "same plan in two namespaces",
+			rows: []ChargebackRow{
+				instance("b", "default", "i1", 1),
+				instance("a", "default", "i2", 2),
+			},
+			want: []ChargebackRow{
+				instance("a", "default", "i2", 2),
+				planTotal("a", "default", 2, 1),
+				namespaceTotal("a", 2, 1),
+				instance("b", "default", "i1", 1),
+				planTotal("b", "default", 1, 1),
+				namespaceTotal("b", 1, 1),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregateChargeback(tt.rows)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregateChargeback() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
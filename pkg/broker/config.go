@@ -0,0 +1,545 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// BackendConfig configures an RGW backend next to the default one.
+type BackendConfig struct {
+	Name            string `json:"name"`
+	Endpoint        string `json:"endpoint"`
+	Zonegroup       string `json:"zonegroup,omitempty"`
+	WebsiteEndpoint string `json:"websiteEndpoint,omitempty"`
+	AccessKey       string `json:"accessKey,omitempty"`
+	Secret          string `json:"secret,omitempty"`
+	// files holding the admin keys, e.g. mounted from a Kubernetes Secret,
+	// read instead of AccessKey and Secret when set
+	AccessKeyFile string `json:"accessKeyFile,omitempty"`
+	SecretFile    string `json:"secretFile,omitempty"`
+	// namespaces whose instances may pick the backend through the "backend"
+	// parameter, none when empty
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// KMSConfig configures the kms the keys of the SSE-KMS instances are created in.
+type KMSConfig struct {
+	// "vault" or "file", empty when no kms is configured
+	Backend           string `json:"backend,omitempty"`
+	KeysFile          string `json:"keysFile,omitempty"`
+	VaultAddr         string `json:"vaultAddr,omitempty"`
+	VaultToken        string `json:"vaultToken,omitempty"`
+	VaultTokenFile    string `json:"vaultTokenFile,omitempty"`
+	VaultTransitMount string `json:"vaultTransitMount,omitempty"`
+}
+
+// Config is the configuration of the broker. It is loaded from the defaults,
+// the configuration file, the environment and the command line flags, each
+// overriding the previous ones.
+type Config struct {
+	// port the broker listens on
+	Port int `json:"port,omitempty"`
+	// address the usage, chargeback and orphan reports are served on, empty
+	// to not serve them
+	ReportAddr string `json:"reportAddr,omitempty"`
+	// externally reachable url of the report listener, for the instance
+	// dashboards. The broker listener doesn't serve the reports.
+	ReportURL string `json:"reportURL,omitempty"`
+
+	// the default backend, which also holds the data bucket
+	Endpoint        string `json:"endpoint"`
+	Zonegroup       string `json:"zonegroup,omitempty"`
+	WebsiteEndpoint string `json:"websiteEndpoint,omitempty"`
+	AccessKey       string `json:"accessKey,omitempty"`
+	Secret          string `json:"secret,omitempty"`
+	AccessKeyFile   string `json:"accessKeyFile,omitempty"`
+	SecretFile      string `json:"secretFile,omitempty"`
+	// how often the key files are checked for rotated keys, 0 disables it
+	CredentialsPollSeconds int `json:"credentialsPollSeconds,omitempty"`
+
+	NamespacePolicy string   `json:"namespacePolicy,omitempty"`
+	AuditSinks      []string `json:"auditSinks,omitempty"`
+	AuditFile       string   `json:"auditFile,omitempty"`
+
+	UIDPrefix       string   `json:"uidPrefix,omitempty"`
+	GCUser          string   `json:"gcUser,omitempty"`
+	DataBucket      string   `json:"dataBucket,omitempty"`
+	AdoptNamespaces []string `json:"adoptNamespaces,omitempty"`
+	AdoptOwners     []string `json:"adoptOwners,omitempty"`
+
+	BucketNameTemplate    string   `json:"bucketNameTemplate,omitempty"`
+	BucketReservedNames   []string `json:"bucketReservedNames,omitempty"`
+	BucketAllowedPrefixes []string `json:"bucketAllowedPrefixes,omitempty"`
+	BucketDeniedPrefixes  []string `json:"bucketDeniedPrefixes,omitempty"`
+
+	SharedBucket   string `json:"sharedBucket,omitempty"`
+	SharedPrefixGC string `json:"sharedPrefixGC,omitempty"`
+
+	// smallest minimum age the orphan scanner accepts
+	OrphanMinAgeFloorSeconds int `json:"orphanMinAgeFloorSeconds,omitempty"`
+
+	// hosts the "notifications" endpoints may point to, notifications are
+	// not offered when empty
+	NotificationHosts []string `json:"notificationHosts,omitempty"`
+
+	Backends []BackendConfig `json:"backends,omitempty"`
+	// maps plan names to backend names, and to "<placement>[/<storage class>]"
+	PlanBackends   map[string]string `json:"planBackends,omitempty"`
+	PlanPlacements map[string]string `json:"planPlacements,omitempty"`
+
+	KMS KMSConfig `json:"kms,omitempty"`
+
+	// runs the broker as one of several replicas, which lock the instances
+	// they work on through ConfigMaps in LockNamespace. A single replica
+	// locks files in LockDir, which the commands run in its pod share.
+	HA                 bool   `json:"ha,omitempty"`
+	LockNamespace      string `json:"lockNamespace,omitempty"`
+	LockTTLSeconds     int    `json:"lockTTLSeconds,omitempty"`
+	LockTimeoutSeconds int    `json:"lockTimeoutSeconds,omitempty"`
+	LockDir            string `json:"lockDir,omitempty"`
+}
+
+// Returns the configuration used when nothing is configured.
+func defaultConfig() *Config {
+	return &Config{
+		Port:                     8005,
+		ReportAddr:               "127.0.0.1:8006",
+		CredentialsPollSeconds:   30,
+		AuditSinks:               []string{AUDIT_SINK_STDOUT},
+		UIDPrefix:                "kube-rgw.",
+		DataBucket:               "kube-rgw-data",
+		SharedBucket:             "kube-rgw-shared",
+		SharedPrefixGC:           SHARED_PREFIX_ARCHIVE,
+		OrphanMinAgeFloorSeconds: 3600,
+		LockTTLSeconds:           60,
+		LockTimeoutSeconds:       30,
+		LockDir:                  "/tmp/rgw-broker-locks",
+	}
+}
+
+// configFlags are the settings that can be given on the command line, with
+// the environment variables they override.
+var configFlags = []struct {
+	name  string
+	env   string
+	usage string
+}{
+	{"config", "RGW_CONFIG_FILE", "configuration file of the broker"},
+	{"port", "RGW_BROKER_PORT", "port for the broker to listen on"},
+	{"report-addr", "RGW_REPORT_ADDR", "address to serve the reports on, empty to not serve them"},
+	{"report-url", "RGW_REPORT_URL", "externally reachable url of the reports, for the instance dashboards"},
+	{"rgw-endpoint", "RGW_ENDPOINT", "endpoint of the default RGW backend"},
+	{"rgw-zonegroup", "RGW_ZONEGROUP", "zonegroup of the default RGW backend"},
+	{"rgw-access-key-file", "RGW_ACCESS_KEY_FILE", "file holding the admin access key of the default RGW backend"},
+	{"rgw-secret-file", "RGW_SECRET_FILE", "file holding the admin secret key of the default RGW backend"},
+	{"uid-prefix", "RGW_UID_PREFIX", "prefix of the RGW users created by the broker"},
+	{"data-bucket", "RGW_DATA_BUCKET", "bucket holding the broker records"},
+	{"namespace-policy", "RGW_NAMESPACE_POLICY", "namespace policy file"},
+	{"audit-sinks", "RGW_AUDIT_SINKS", "comma separated audit sinks"},
+}
+
+// RegisterConfigFlags adds the configuration flags to the flag set. Once the
+// flags are parsed, the returned function gives the values of the flags set on
+// the command line, keyed by the environment variable they override.
+func RegisterConfigFlags(fs *flag.FlagSet) func() map[string]string {
+	values := make(map[string]*string)
+	for _, f := range configFlags {
+		values[f.name] = fs.String(f.name, "", f.usage)
+	}
+	return func() map[string]string {
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			for _, cf := range configFlags {
+				if cf.name == f.Name {
+					set[cf.env] = *values[f.Name]
+				}
+			}
+		})
+		return set
+	}
+}
+
+// LoadConfig loads the configuration from the defaults, the file named by
+// RGW_CONFIG_FILE (or the --config flag), the environment ("NAME=value"
+// entries) and the flags, then reads the secret files and validates the
+// result. Empty environment variables are ignored, so that deployments
+// setting every variable don't clear the configuration file; flags given on
+// the command line apply even when empty.
+func LoadConfig(environ []string, flags map[string]string) (*Config, error) {
+	env := make(map[string]string)
+	for _, e := range environ {
+		// values may contain '=', only the first one separates the name
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) == 2 && pair[1] != "" {
+			env[pair[0]] = pair[1]
+		}
+	}
+
+	cfg := defaultConfig()
+	path := env["RGW_CONFIG_FILE"]
+	if p, ok := flags["RGW_CONFIG_FILE"]; ok {
+		path = p
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration file: %v", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse configuration file %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(env); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(flags); err != nil {
+		return nil, err
+	}
+	if err := cfg.readSecrets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Overrides the configuration with the variables that are set.
+func (c *Config) applyEnv(env map[string]string) error {
+	for name, val := range env {
+		switch name {
+		case "RGW_BROKER_PORT":
+			port, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, val)
+			}
+			c.Port = port
+		case "RGW_REPORT_ADDR":
+			c.ReportAddr = val
+		case "RGW_REPORT_URL":
+			c.ReportURL = val
+		case "RGW_ENDPOINT":
+			c.Endpoint = val
+		case "RGW_ZONEGROUP":
+			c.Zonegroup = val
+		case "RGW_ACCESS_KEY":
+			c.AccessKey = val
+		case "RGW_SECRET":
+			c.Secret = val
+		case "RGW_ACCESS_KEY_FILE":
+			c.AccessKeyFile = val
+		case "RGW_SECRET_FILE":
+			c.SecretFile = val
+		case "RGW_CREDENTIALS_POLL_SECONDS":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, val)
+			}
+			c.CredentialsPollSeconds = seconds
+		case "RGW_WEBSITE_ENDPOINT":
+			c.WebsiteEndpoint = val
+		case "RGW_NAMESPACE_POLICY":
+			c.NamespacePolicy = val
+		case "RGW_AUDIT_SINKS":
+			c.AuditSinks = splitList(val)
+		case "RGW_AUDIT_FILE":
+			c.AuditFile = val
+		case "RGW_UID_PREFIX":
+			c.UIDPrefix = val
+		case "RGW_GC_USER":
+			c.GCUser = val
+		case "RGW_DATA_BUCKET":
+			c.DataBucket = val
+		case "RGW_ADOPT_NAMESPACES":
+			c.AdoptNamespaces = splitList(val)
+		case "RGW_ADOPT_OWNERS":
+			c.AdoptOwners = splitList(val)
+		case "RGW_BUCKET_NAME_TEMPLATE":
+			c.BucketNameTemplate = val
+		case "RGW_BUCKET_RESERVED_NAMES":
+			c.BucketReservedNames = splitList(val)
+		case "RGW_BUCKET_ALLOWED_PREFIXES":
+			c.BucketAllowedPrefixes = splitList(val)
+		case "RGW_BUCKET_DENIED_PREFIXES":
+			c.BucketDeniedPrefixes = splitList(val)
+		case "RGW_SHARED_BUCKET":
+			c.SharedBucket = val
+		case "RGW_SHARED_PREFIX_GC":
+			c.SharedPrefixGC = val
+		case "RGW_ORPHAN_MIN_AGE_FLOOR_SECONDS":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, val)
+			}
+			c.OrphanMinAgeFloorSeconds = seconds
+		case "RGW_NOTIFICATION_HOSTS":
+			c.NotificationHosts = splitList(val)
+		case "RGW_PLAN_BACKENDS":
+			m, err := parsePlanMap(name, val, "<plan>:<backend>")
+			if err != nil {
+				return err
+			}
+			c.PlanBackends = m
+		case "RGW_PLAN_PLACEMENTS":
+			m, err := parsePlanMap(name, val, "<plan>:<placement>[/<storage class>]")
+			if err != nil {
+				return err
+			}
+			c.PlanPlacements = m
+		case "RGW_HA":
+			ha, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, val)
+			}
+			c.HA = ha
+		case "RGW_LOCK_NAMESPACE":
+			c.LockNamespace = val
+		case "RGW_LOCK_TTL_SECONDS":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, val)
+			}
+			c.LockTTLSeconds = seconds
+		case "RGW_LOCK_TIMEOUT_SECONDS":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, val)
+			}
+			c.LockTimeoutSeconds = seconds
+		case "RGW_LOCK_DIR":
+			c.LockDir = val
+		case "RGW_KMS_BACKEND":
+			c.KMS.Backend = val
+		case "RGW_KMS_KEYS_FILE":
+			c.KMS.KeysFile = val
+		case "RGW_KMS_VAULT_ADDR":
+			c.KMS.VaultAddr = val
+		case "RGW_KMS_VAULT_TOKEN":
+			c.KMS.VaultToken = val
+		case "RGW_KMS_VAULT_TOKEN_FILE":
+			c.KMS.VaultTokenFile = val
+		case "RGW_KMS_VAULT_TRANSIT_MOUNT":
+			c.KMS.VaultTransitMount = val
+		}
+	}
+
+	// RGW_BACKENDS replaces the backends of the configuration file, keeping
+	// the settings of the ones it lists
+	if val, ok := env["RGW_BACKENDS"]; ok {
+		var backends []BackendConfig
+		for _, name := range splitList(val) {
+			backend := BackendConfig{Name: name}
+			for _, old := range c.Backends {
+				if old.Name == name {
+					backend = old
+				}
+			}
+			backends = append(backends, backend)
+		}
+		c.Backends = backends
+	}
+	for i := range c.Backends {
+		c.Backends[i].applyEnv(env)
+	}
+	return nil
+}
+
+// Overrides the backend configuration with its RGW_BACKEND_<NAME>_ENDPOINT,
+// _ZONEGROUP, _ACCESS_KEY, _SECRET, _ACCESS_KEY_FILE, _SECRET_FILE,
+// _WEBSITE_ENDPOINT and _NAMESPACES variables.
+func (c *BackendConfig) applyEnv(env map[string]string) {
+	prefix := backendEnvPrefix(c.Name)
+	for name, val := range env {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		switch strings.TrimPrefix(name, prefix) {
+		case "ENDPOINT":
+			c.Endpoint = val
+		case "ZONEGROUP":
+			c.Zonegroup = val
+		case "ACCESS_KEY":
+			c.AccessKey = val
+		case "SECRET":
+			c.Secret = val
+		case "ACCESS_KEY_FILE":
+			c.AccessKeyFile = val
+		case "SECRET_FILE":
+			c.SecretFile = val
+		case "WEBSITE_ENDPOINT":
+			c.WebsiteEndpoint = val
+		case "NAMESPACES":
+			c.Namespaces = splitList(val)
+		}
+	}
+}
+
+// Parses "<plan>:<value>,..." lists.
+func parsePlanMap(name, val, format string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range splitList(val) {
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected %s", name, entry, format)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// Reads a secret from a file, ignoring the trailing new line Secrets often
+// have.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// secretFile is a secret that may be read from a file.
+type secretFile struct {
+	path  string
+	value *string
+}
+
+// Replaces the secrets that are given as files with the content of the files.
+func (c *Config) readSecrets() error {
+	secrets := []secretFile{
+		{c.AccessKeyFile, &c.AccessKey},
+		{c.SecretFile, &c.Secret},
+		{c.KMS.VaultTokenFile, &c.KMS.VaultToken},
+	}
+	for i := range c.Backends {
+		secrets = append(secrets,
+			secretFile{c.Backends[i].AccessKeyFile, &c.Backends[i].AccessKey},
+			secretFile{c.Backends[i].SecretFile, &c.Backends[i].Secret})
+	}
+	for _, s := range secrets {
+		if s.path == "" {
+			continue
+		}
+		val, err := readSecretFile(s.path)
+		if err != nil {
+			return err
+		}
+		*s.value = val
+	}
+	return nil
+}
+
+// Checks the configuration, reporting all the problems at once.
+func (c *Config) validate() error {
+	var errs []string
+	if c.Port <= 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("invalid port %d", c.Port))
+	}
+	if c.CredentialsPollSeconds < 0 {
+		errs = append(errs, fmt.Sprintf("invalid credentials poll interval %d", c.CredentialsPollSeconds))
+	}
+	if c.OrphanMinAgeFloorSeconds < 0 {
+		errs = append(errs, fmt.Sprintf("invalid orphan minimum age floor %d", c.OrphanMinAgeFloorSeconds))
+	}
+	if c.Endpoint == "" {
+		errs = append(errs, "no RGW endpoint, set RGW_ENDPOINT")
+	}
+	if c.AccessKey == "" || c.Secret == "" {
+		errs = append(errs, "no RGW admin keys, set RGW_ACCESS_KEY and RGW_SECRET or RGW_ACCESS_KEY_FILE and RGW_SECRET_FILE")
+	}
+	if c.DataBucket == "" {
+		errs = append(errs, "no data bucket, set RGW_DATA_BUCKET")
+	}
+	if c.ReportURL != "" && c.ReportAddr == "" {
+		errs = append(errs, "RGW_REPORT_URL is set but the reports are not served, set RGW_REPORT_ADDR")
+	}
+	if c.SharedPrefixGC != SHARED_PREFIX_ARCHIVE && c.SharedPrefixGC != SHARED_PREFIX_DELETE {
+		errs = append(errs, fmt.Sprintf("invalid RGW_SHARED_PREFIX_GC %q, expected %q or %q", c.SharedPrefixGC, SHARED_PREFIX_ARCHIVE, SHARED_PREFIX_DELETE))
+	}
+
+	backends := map[string]bool{DEFAULT_BACKEND: true}
+	for _, backend := range c.Backends {
+		if backend.Name == "" {
+			errs = append(errs, "backend without a name")
+			continue
+		}
+		if backends[backend.Name] {
+			errs = append(errs, fmt.Sprintf("backend %q configured more than once", backend.Name))
+		}
+		backends[backend.Name] = true
+		if backend.Endpoint == "" {
+			errs = append(errs, fmt.Sprintf("backend %q has no endpoint, set %sENDPOINT", backend.Name, backendEnvPrefix(backend.Name)))
+		}
+	}
+	for plan, backend := range c.PlanBackends {
+		if !backends[backend] {
+			errs = append(errs, fmt.Sprintf("plan %q is mapped to unknown backend %q", plan, backend))
+		}
+	}
+
+	for _, sink := range c.AuditSinks {
+		switch sink {
+		case AUDIT_SINK_STDOUT, AUDIT_SINK_BUCKET:
+		case AUDIT_SINK_FILE:
+			if c.AuditFile == "" {
+				errs = append(errs, fmt.Sprintf("RGW_AUDIT_FILE is needed by the %q audit sink", AUDIT_SINK_FILE))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("invalid audit sink %q, expected %q, %q or %q", sink, AUDIT_SINK_STDOUT, AUDIT_SINK_FILE, AUDIT_SINK_BUCKET))
+		}
+	}
+
+	switch c.KMS.Backend {
+	case "":
+	case KMS_BACKEND_VAULT:
+		if c.KMS.VaultAddr == "" || c.KMS.VaultToken == "" {
+			errs = append(errs, fmt.Sprintf("RGW_KMS_VAULT_ADDR and RGW_KMS_VAULT_TOKEN are needed by the %q kms backend", KMS_BACKEND_VAULT))
+		}
+	case KMS_BACKEND_FILE:
+		if c.KMS.KeysFile == "" {
+			errs = append(errs, fmt.Sprintf("RGW_KMS_KEYS_FILE is needed by the %q kms backend", KMS_BACKEND_FILE))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("invalid RGW_KMS_BACKEND %q, expected %q or %q", c.KMS.Backend, KMS_BACKEND_VAULT, KMS_BACKEND_FILE))
+	}
+
+	if c.HA {
+		if c.LockNamespace == "" {
+			errs = append(errs, "no namespace for the locks of the HA mode, set RGW_LOCK_NAMESPACE")
+		}
+		if c.LockTTLSeconds < 3 {
+			errs = append(errs, fmt.Sprintf("lock TTL of %d seconds is too short", c.LockTTLSeconds))
+		}
+	} else if c.LockDir == "" {
+		errs = append(errs, "no directory for the locks, set RGW_LOCK_DIR")
+	}
+	if c.LockTimeoutSeconds <= 0 {
+		errs = append(errs, fmt.Sprintf("invalid lock timeout of %d seconds", c.LockTimeoutSeconds))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
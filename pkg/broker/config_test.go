@@ -0,0 +1,163 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgw-broker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(configFile, []byte(`
+port: 9000
+endpoint: http://file:8000
+accessKey: file-access
+secret: file-secret
+uidPrefix: file-
+backends:
+- name: archive
+  endpoint: http://archive:8000
+  zonegroup: b
+- name: old
+  endpoint: http://old:8000
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("file-content-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"RGW_ENDPOINT=http://env:8000", "RGW_ACCESS_KEY=env-access", "RGW_SECRET=env-secret"}
+	tests := []struct {
+		name    string
+		environ []string
+		flags   map[string]string
+		check   func(c *Config) interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:    "defaults",
+			environ: keys,
+			check:   func(c *Config) interface{} { return []interface{}{c.Port, c.UIDPrefix, c.ReportAddr} },
+			want:    []interface{}{8005, "kube-rgw.", "127.0.0.1:8006"},
+		},
+		{
+			name:    "file overrides the defaults",
+			environ: []string{"RGW_CONFIG_FILE=" + configFile},
+			check:   func(c *Config) interface{} { return []interface{}{c.Port, c.Endpoint, c.UIDPrefix} },
+			want:    []interface{}{9000, "http://file:8000", "file-"},
+		},
+		{
+			name:    "environment overrides the file",
+			environ: []string{"RGW_CONFIG_FILE=" + configFile, "RGW_ENDPOINT=http://env:8000", "RGW_UID_PREFIX=env-"},
+			check:   func(c *Config) interface{} { return []interface{}{c.Endpoint, c.UIDPrefix} },
+			want:    []interface{}{"http://env:8000", "env-"},
+		},
+		{
+			name:    "empty environment variables are ignored",
+			environ: []string{"RGW_CONFIG_FILE=" + configFile, "RGW_UID_PREFIX=", "RGW_BACKENDS="},
+			check:   func(c *Config) interface{} { return []interface{}{c.UIDPrefix, len(c.Backends)} },
+			want:    []interface{}{"file-", 2},
+		},
+		{
+			name:    "flags override the environment",
+			environ: []string{"RGW_CONFIG_FILE=" + configFile, "RGW_BROKER_PORT=9001"},
+			flags:   map[string]string{"RGW_BROKER_PORT": "9002", "RGW_REPORT_ADDR": ""},
+			check:   func(c *Config) interface{} { return []interface{}{c.Port, c.ReportAddr} },
+			want:    []interface{}{9002, ""},
+		},
+		{
+			name:    "config file flag",
+			environ: []string{"RGW_CONFIG_FILE=" + filepath.Join(dir, "missing.yaml")},
+			flags:   map[string]string{"RGW_CONFIG_FILE": configFile},
+			check:   func(c *Config) interface{} { return c.Port },
+			want:    9000,
+		},
+		{
+			name: "backends listed in the environment keep their file settings",
+			environ: []string{"RGW_CONFIG_FILE=" + configFile, "RGW_BACKENDS=archive,new",
+				"RGW_BACKEND_ARCHIVE_ENDPOINT=http://archive-env:8000", "RGW_BACKEND_NEW_ENDPOINT=http://new:8000"},
+			check: func(c *Config) interface{} { return c.Backends },
+			want: []BackendConfig{
+				{Name: "archive", Endpoint: "http://archive-env:8000", Zonegroup: "b"},
+				{Name: "new", Endpoint: "http://new:8000"},
+			},
+		},
+		{
+			name:    "secret files override the plain secrets",
+			environ: append(keys, "RGW_SECRET_FILE="+secretFile),
+			check:   func(c *Config) interface{} { return c.Secret },
+			want:    "file-content-secret",
+		},
+		{
+			name:    "missing secret file",
+			environ: append(keys, "RGW_SECRET_FILE="+filepath.Join(dir, "missing")),
+			wantErr: true,
+		},
+		{
+			name:    "invalid port",
+			environ: append(keys, "RGW_BROKER_PORT=http"),
+			wantErr: true,
+		},
+		{
+			name:    "no endpoint",
+			environ: []string{"RGW_ACCESS_KEY=env-access", "RGW_SECRET=env-secret"},
+			wantErr: true,
+		},
+		{
+			name:    "report url without a report listener",
+			environ: append(keys, "RGW_REPORT_URL=https://reports.example.com"),
+			flags:   map[string]string{"RGW_REPORT_ADDR": ""},
+			wantErr: true,
+		},
+		{
+			name:    "backend without endpoint",
+			environ: append(keys, "RGW_BACKENDS=archive"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(tt.environ, tt.flags)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig() = %+v, want an error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() failed: %v", err)
+			}
+			if got := tt.check(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadConfig() gave %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
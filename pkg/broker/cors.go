@@ -0,0 +1,117 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	CORS = "cors"
+)
+
+var corsMethods = map[string]bool{
+	"GET":    true,
+	"PUT":    true,
+	"POST":   true,
+	"DELETE": true,
+	"HEAD":   true,
+}
+
+// corsRule is a bucket CORS rule as accepted in the "cors" parameter.
+type corsRule struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+	AllowedMethods []string `json:"allowedMethods"`
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	ExposeHeaders  []string `json:"exposeHeaders,omitempty"`
+	MaxAgeSeconds  int64    `json:"maxAgeSeconds,omitempty"`
+}
+
+// Parses and validates the "cors" parameter, a list of rules.
+func parseCors(val interface{}) ([]corsRule, error) {
+	rules := []corsRule{}
+	if err := decodeParam(CORS, val, &rules); err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if len(r.AllowedOrigins) == 0 {
+			return nil, retErrInfof("Error: %q rule %d has no allowed origins", CORS, i)
+		}
+		if len(r.AllowedMethods) == 0 {
+			return nil, retErrInfof("Error: %q rule %d has no allowed methods", CORS, i)
+		}
+		for j, m := range r.AllowedMethods {
+			m = strings.ToUpper(m)
+			if !corsMethods[m] {
+				return nil, retErrInfof("Error: %q rule %d has unsupported method %q", CORS, i, m)
+			}
+			r.AllowedMethods[j] = m
+		}
+		if r.MaxAgeSeconds < 0 {
+			return nil, retErrInfof("Error: %q rule %d has a negative max age", CORS, i)
+		}
+	}
+	return rules, nil
+}
+
+// Sets the CORS configuration of the bucket, removing it if there are no rules.
+func (c *RGWClient) setBucketCors(bucketName string, rules []corsRule) error {
+	glog.Infof("Setting %d CORS rules on bucket %q", len(rules), bucketName)
+
+	if len(rules) == 0 {
+		_, err := c.client.DeleteBucketCors(&s3.DeleteBucketCorsInput{
+			Bucket: &bucketName,
+		})
+		if err != nil {
+			return retErrInfof("Error removing CORS of bucket %s: %v", bucketName, err)
+		}
+		return nil
+	}
+
+	config := &s3.CORSConfiguration{}
+	for _, r := range rules {
+		rule := &s3.CORSRule{
+			AllowedOrigins: aws.StringSlice(r.AllowedOrigins),
+			AllowedMethods: aws.StringSlice(r.AllowedMethods),
+		}
+		if len(r.AllowedHeaders) > 0 {
+			rule.AllowedHeaders = aws.StringSlice(r.AllowedHeaders)
+		}
+		if len(r.ExposeHeaders) > 0 {
+			rule.ExposeHeaders = aws.StringSlice(r.ExposeHeaders)
+		}
+		if r.MaxAgeSeconds > 0 {
+			rule.MaxAgeSeconds = aws.Int64(r.MaxAgeSeconds)
+		}
+		config.CORSRules = append(config.CORSRules, rule)
+	}
+
+	_, err := c.client.PutBucketCors(&s3.PutBucketCorsInput{
+		Bucket:            &bucketName,
+		CORSConfiguration: config,
+	})
+	if err != nil {
+		return retErrInfof("Error setting CORS of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
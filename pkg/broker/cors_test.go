@@ -0,0 +1,77 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseCors(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    []corsRule
+		wantErr bool
+	}{
+		{
+			name:  "rules",
+			param: `[{"allowedOrigins":["https://example.com"],"allowedMethods":["GET","PUT"],"allowedHeaders":["*"],"exposeHeaders":["ETag"],"maxAgeSeconds":300}]`,
+			want: []corsRule{{
+				AllowedOrigins: []string{"https://example.com"},
+				AllowedMethods: []string{"GET", "PUT"},
+				AllowedHeaders: []string{"*"},
+				ExposeHeaders:  []string{"ETag"},
+				MaxAgeSeconds:  300,
+			}},
+		},
+		{
+			name:  "lowercase methods",
+			param: `[{"allowedOrigins":["*"],"allowedMethods":["get","head"]}]`,
+			want:  []corsRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET", "HEAD"}}},
+		},
+		{name: "empty list", param: `[]`, want: []corsRule{}},
+		{name: "not a list", param: `{"allowedOrigins":["*"],"allowedMethods":["GET"]}`, wantErr: true},
+		{name: "unknown field", param: `[{"allowedOrigins":["*"],"allowedMethods":["GET"],"origins":["*"]}]`, wantErr: true},
+		{name: "no origins", param: `[{"allowedMethods":["GET"]}]`, wantErr: true},
+		{name: "no methods", param: `[{"allowedOrigins":["*"]}]`, wantErr: true},
+		{name: "unsupported method", param: `[{"allowedOrigins":["*"],"allowedMethods":["PATCH"]}]`, wantErr: true},
+		{name: "negative max age", param: `[{"allowedOrigins":["*"],"allowedMethods":["GET"],"maxAgeSeconds":-1}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var val interface{}
+			if err := json.Unmarshal([]byte(tt.param), &val); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseCors(val)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseCors(%s) = %+v, want an error", tt.param, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCors(%s) failed: %v", tt.param, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCors(%s) = %+v, want %+v", tt.param, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/golang/glog"
+)
+
+// rotatingCredentials hands the current keys of an RGWClient to its s3 client,
+// which fetches them again once they are rotated.
+type rotatingCredentials struct {
+	c *RGWClient
+	// generation of the keys retrieved last
+	generation int
+}
+
+func (p *rotatingCredentials) Retrieve() (credentials.Value, error) {
+	user, generation := p.c.credentials()
+	p.generation = generation
+	return credentials.Value{
+		AccessKeyID:     user.accessKey,
+		SecretAccessKey: user.secret,
+		ProviderName:    "RGWClient",
+	}, nil
+}
+
+func (p *rotatingCredentials) IsExpired() bool {
+	_, generation := p.c.credentials()
+	return generation != p.generation
+}
+
+// Returns the keys the client signs its requests with, and their generation.
+func (c *RGWClient) credentials() (RGWUser, int) {
+	c.credsLock.RLock()
+	defer c.credsLock.RUnlock()
+	return c.user, c.credsGeneration
+}
+
+// Replaces the keys the client signs its requests with. Requests already
+// signed keep the previous keys.
+func (c *RGWClient) setCredentials(user RGWUser) {
+	c.credsLock.Lock()
+	defer c.credsLock.Unlock()
+	c.user = user
+	c.credsGeneration++
+}
+
+// Checks that RGW accepts the keys for admin requests, by fetching the user
+// owning them.
+func (c *RGWClient) validateCredentials(user RGWUser) error {
+	candidate := &RGWClient{
+		backend:   c.backend,
+		endpoint:  c.endpoint,
+		zonegroup: c.zonegroup,
+		user:      user,
+	}
+	params := make(url.Values)
+	params.Set("access-key", user.accessKey)
+	if _, err := candidate.rgwAdminRequest("GET", "user", "", params, nil); err != nil {
+		return fmt.Errorf("RGW rejected the new keys of backend %q: %v", c.backend, err)
+	}
+	return nil
+}
+
+// credentialSource is a backend whose admin keys are read from files, e.g.
+// mounted from a Kubernetes Secret, and are picked up again when they change.
+type credentialSource struct {
+	client        *RGWClient
+	accessKeyFile string
+	secretFile    string
+}
+
+// Returns the sources of the rotatable admin keys of the configured backends.
+func credentialSources(cfg *Config, backends map[string]*RGWClient) []credentialSource {
+	var sources []credentialSource
+	if cfg.AccessKeyFile != "" || cfg.SecretFile != "" {
+		sources = append(sources, credentialSource{backends[DEFAULT_BACKEND], cfg.AccessKeyFile, cfg.SecretFile})
+	}
+	for _, backend := range cfg.Backends {
+		if backend.AccessKeyFile != "" || backend.SecretFile != "" {
+			sources = append(sources, credentialSource{backends[backend.Name], backend.AccessKeyFile, backend.SecretFile})
+		}
+	}
+	return sources
+}
+
+// Reads the keys from the files, and switches the client to them if they
+// changed and RGW accepts them. The client keeps its keys otherwise.
+func (s *credentialSource) refresh() error {
+	current, _ := s.client.credentials()
+	user := current
+	var err error
+	if s.accessKeyFile != "" {
+		if user.accessKey, err = readSecretFile(s.accessKeyFile); err != nil {
+			return err
+		}
+	}
+	if s.secretFile != "" {
+		if user.secret, err = readSecretFile(s.secretFile); err != nil {
+			return err
+		}
+	}
+	if user == current {
+		return nil
+	}
+
+	if err := s.client.validateCredentials(user); err != nil {
+		return err
+	}
+	s.client.setCredentials(user)
+	glog.Infof("Rotated the admin keys of backend %q to access key %s", s.client.backend, user.accessKey)
+	return nil
+}
+
+// Polls the credential sources for rotated keys. Kubernetes updates mounted
+// Secrets in place, so polling picks up rotations without a restart.
+func watchCredentials(sources []credentialSource, interval time.Duration) {
+	if len(sources) == 0 || interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		for i := range sources {
+			if err := sources[i].refresh(); err != nil {
+				glog.Errorf("Failed to rotate admin keys: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	SSE_S3  = s3.ServerSideEncryptionAes256
+	SSE_KMS = s3.ServerSideEncryptionAwsKms
+)
+
+// Returns the id of the KMS key of an instance.
+func kmsKeyID(instanceID string) string {
+	return "rgw-broker-" + instanceID
+}
+
+// Prepares the default encryption of the buckets of a new instance, creating
+// its KMS key for SSE-KMS plans. Returns the key id, empty unless SSE-KMS.
+func (b *broker) prepareEncryption(instanceID string, plan *rgwPlan) (string, error) {
+	if plan.encryption != SSE_KMS {
+		return "", nil
+	}
+	if b.kms == nil {
+		return "", retErrInfof("Error: no kms configured for plan %q", plan.name)
+	}
+	keyID := kmsKeyID(instanceID)
+	if err := b.kms.createKey(keyID); err != nil {
+		return "", retErrInfof("Error: failed to create kms key: %v", err)
+	}
+	return keyID, nil
+}
+
+// Sets the default encryption of the bucket, with the given KMS key for SSE-KMS.
+func (c *RGWClient) setBucketEncryption(bucketName, algorithm, keyID string) error {
+	glog.Infof("Setting default encryption of bucket %q to %s %s", bucketName, algorithm, keyID)
+
+	sse := &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(algorithm)}
+	if keyID != "" {
+		sse.KMSMasterKeyID = aws.String(keyID)
+	}
+
+	_, err := c.client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: &bucketName,
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{
+				{ApplyServerSideEncryptionByDefault: sse},
+			},
+		},
+	})
+	if err != nil {
+		return retErrInfof("Error setting default encryption of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rs/xid"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// label of the ConfigMaps used as locks
+	LOCK_LABEL = "rgw-object-broker/lock"
+
+	lockHolderKey  = "holder"
+	lockExpiresKey = "expires"
+)
+
+// configMapLocks holds locks as ConfigMaps, which are created by the replica
+// taking the lock and deleted when it releases it. A lock records its holder
+// and when it expires. The holder renews it while the operation runs, and a
+// lock that expired, because its holder died, is taken over through an update
+// conditioned on the version of the ConfigMap.
+type configMapLocks struct {
+	client    corev1.ConfigMapInterface
+	namespace string
+	// identifies this replica
+	holder  string
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+var invalidLockNameChars = regexp.MustCompile("[^a-z0-9.-]")
+
+func newConfigMapLocks(client corev1.ConfigMapsGetter, namespace string, ttl, timeout time.Duration) *configMapLocks {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "rgw-broker"
+	}
+	return &configMapLocks{
+		client:    client.ConfigMaps(namespace),
+		namespace: namespace,
+		holder:    host + "-" + xid.New().String(),
+		ttl:       ttl,
+		timeout:   timeout,
+	}
+}
+
+// Returns the name of the ConfigMap of a key.
+func (l *configMapLocks) name(key string) string {
+	name := "rgw-broker-lock-" + invalidLockNameChars.ReplaceAllString(strings.ToLower(key), "-")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return name
+}
+
+func (l *configMapLocks) record() map[string]string {
+	return map[string]string{
+		lockHolderKey:  l.holder,
+		lockExpiresKey: time.Now().Add(l.ttl).UTC().Format(time.RFC3339),
+	}
+}
+
+func (l *configMapLocks) lock(key string) (func(), error) {
+	name := l.name(key)
+	deadline := time.Now().Add(l.timeout)
+	delay := 100 * time.Millisecond
+	for {
+		acquired, err := l.tryLock(name)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return l.keepAlive(name), nil
+		}
+		if time.Now().After(deadline) {
+			return nil, retErrInfof("Error: %s is busy with another operation, try again later", key)
+		}
+		time.Sleep(delay)
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// Takes the lock if it is free or expired.
+func (l *configMapLocks) tryLock(name string) (bool, error) {
+	_, err := l.client.Create(&v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{LOCK_LABEL: "true"},
+		},
+		Data: l.record(),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return false, fmt.Errorf("failed to create lock %s/%s: %v", l.namespace, name, err)
+	}
+
+	current, err := l.client.Get(name, meta_v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// released in the meantime
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read lock %s/%s: %v", l.namespace, name, err)
+	}
+	expires, err := time.Parse(time.RFC3339, current.Data[lockExpiresKey])
+	if err == nil && time.Now().Before(expires) {
+		return false, nil
+	}
+
+	glog.Infof("Taking over expired lock %s/%s of %s", l.namespace, name, current.Data[lockHolderKey])
+	current.Data = l.record()
+	_, err = l.client.Update(current)
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		// another replica was faster
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to take over lock %s/%s: %v", l.namespace, name, err)
+	}
+	return true, nil
+}
+
+// Renews the lock until the returned function is called, which releases it.
+func (l *configMapLocks) keepAlive(name string) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := l.renew(name); err != nil {
+					glog.Errorf("Failed to renew lock %s/%s: %v", l.namespace, name, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		l.release(name)
+	}
+}
+
+func (l *configMapLocks) renew(name string) error {
+	current, err := l.client.Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if current.Data[lockHolderKey] != l.holder {
+		return fmt.Errorf("lock was taken over by %s", current.Data[lockHolderKey])
+	}
+	current.Data = l.record()
+	_, err = l.client.Update(current)
+	return err
+}
+
+func (l *configMapLocks) release(name string) {
+	current, err := l.client.Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Failed to release lock %s/%s: %v", l.namespace, name, err)
+		return
+	}
+	if current.Data[lockHolderKey] != l.holder {
+		glog.Errorf("Lock %s/%s was taken over by %s before it was released", l.namespace, name, current.Data[lockHolderKey])
+		return
+	}
+	err = l.client.Delete(name, &meta_v1.DeleteOptions{
+		Preconditions: &meta_v1.Preconditions{UID: &current.UID},
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Errorf("Failed to release lock %s/%s: %v", l.namespace, name, err)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// the platform of the identities sent by the Kubernetes service catalog
+const KUBERNETES_PLATFORM = "kubernetes"
+
+// OriginatingIdentity is the platform user that triggered an operation, as
+// sent in the X-Broker-API-Originating-Identity header. The header is not
+// authenticated, so the identity is only recorded and never used to grant
+// access.
+type OriginatingIdentity struct {
+	Platform string              `json:"platform"`
+	Username string              `json:"username,omitempty"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// ParseOriginatingIdentity decodes the X-Broker-API-Originating-Identity
+// header, "<platform> <base64 encoded JSON>". An empty header gives a nil
+// identity. Only the kubernetes platform is understood, the identities of
+// other platforms only record their platform.
+func ParseOriginatingIdentity(header string) (*OriginatingIdentity, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil, nil
+	}
+
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid originating identity header, expected \"<platform> <value>\"")
+	}
+	identity := &OriginatingIdentity{Platform: parts[0]}
+	if identity.Platform != KUBERNETES_PLATFORM {
+		return identity, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid originating identity header: %v", err)
+	}
+	if err := json.Unmarshal(data, identity); err != nil {
+		return nil, fmt.Errorf("invalid originating identity header: %v", err)
+	}
+	identity.Platform = KUBERNETES_PLATFORM
+	return identity, nil
+}
+
+func (i *OriginatingIdentity) String() string {
+	if i == nil {
+		return "unknown"
+	}
+	if i.Username == "" {
+		return i.Platform
+	}
+	return i.Platform + ":" + i.Username
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		want    *OriginatingIdentity
+		wantErr bool
+	}{
+		{
+			name:   "empty",
+			header: "  ",
+			want:   nil,
+		},
+		{
+			name:   "kubernetes",
+			header: "kubernetes " + encode(`{"username":"alice","uid":"42","groups":["dev"],"extra":{"scope":["a"]}}`),
+			want: &OriginatingIdentity{
+				Platform: KUBERNETES_PLATFORM,
+				Username: "alice",
+				UID:      "42",
+				Groups:   []string{"dev"},
+				Extra:    map[string][]string{"scope": {"a"}},
+			},
+		},
+		{
+			name:   "platform in the value is ignored",
+			header: "kubernetes " + encode(`{"platform":"other","username":"alice"}`),
+			want:   &OriginatingIdentity{Platform: KUBERNETES_PLATFORM, Username: "alice"},
+		},
+		{
+			name:   "other platform",
+			header: "cloudfoundry " + encode(`{"user_id":"42"}`),
+			want:   &OriginatingIdentity{Platform: "cloudfoundry"},
+		},
+		{
+			name:    "missing value",
+			header:  "kubernetes",
+			wantErr: true,
+		},
+		{
+			name:    "too many fields",
+			header:  "kubernetes a b",
+			wantErr: true,
+		},
+		{
+			name:    "invalid base64",
+			header:  "kubernetes !!!",
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			header:  "kubernetes " + encode(`{"username":`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOriginatingIdentity(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseOriginatingIdentity() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseOriginatingIdentity() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseOriginatingIdentity() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
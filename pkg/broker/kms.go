@@ -0,0 +1,96 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	KMS_BACKEND_VAULT = "vault"
+	KMS_BACKEND_FILE  = "file"
+)
+
+// keyManager creates the KMS keys used for the SSE-KMS default encryption of
+// instance buckets. RGW has to be configured with the same key management
+// service, so that it can fetch the keys by their id.
+type keyManager interface {
+	// Creates the key with the given id, succeeds if it already exists.
+	createKey(keyID string) error
+}
+
+// Creates the configured key manager, or nil if no kms backend is configured.
+// The configuration is validated by LoadConfig.
+func newKeyManager(cfg KMSConfig) keyManager {
+	switch cfg.Backend {
+	case KMS_BACKEND_VAULT:
+		return newVaultKeyManager(cfg)
+	case KMS_BACKEND_FILE:
+		return &fileKeyManager{path: cfg.KeysFile}
+	default:
+		return nil
+	}
+}
+
+// fileKeyManager is a stand-in for a real KMS, for local testing. Keys are
+// generated by the broker and appended to a file as "<key id>=<base64 key>"
+// lines, which is the format of the "rgw crypt s3 kms encryption keys" option
+// of RGW's testing kms backend. The keys are kept in the clear, so this must
+// never be used in production.
+type fileKeyManager struct {
+	path string
+	lock sync.Mutex
+}
+
+func (m *fileKeyManager) createKey(keyID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Error opening kms keys file %s: %v", m.path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), keyID+"=") {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading kms keys file %s: %v", m.path, err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("Error generating key %s: %v", keyID, err)
+	}
+	glog.Infof("Adding key %q to kms keys file %s", keyID, m.path)
+	if _, err := fmt.Fprintf(f, "%s=%s\n", keyID, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return fmt.Errorf("Error writing kms keys file %s: %v", m.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	LIFECYCLE = "lifecycle"
+)
+
+// lifecycleRule is a bucket lifecycle rule as accepted in the "lifecycle"
+// parameter. Every rule applies to the objects under its prefix, and must
+// have at least one action.
+type lifecycleRule struct {
+	ID     string `json:"id,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+
+	ExpirationDays                  int64                 `json:"expirationDays,omitempty"`
+	NoncurrentVersionExpirationDays int64                 `json:"noncurrentVersionExpirationDays,omitempty"`
+	Transitions                     []lifecycleTransition `json:"transitions,omitempty"`
+	AbortIncompleteMultipartDays    int64                 `json:"abortIncompleteMultipartDays,omitempty"`
+}
+
+type lifecycleTransition struct {
+	Days         int64  `json:"days"`
+	StorageClass string `json:"storageClass"`
+}
+
+// Decodes the parameter value into dst, rejecting unknown fields and values of
+// the wrong type.
+func decodeParam(name string, val interface{}, dst interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return retErrInfof("Error: invalid parameter %q: %v", name, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return retErrInfof("Error: invalid parameter %q: %v", name, err)
+	}
+	return nil
+}
+
+// Parses and validates the "lifecycle" parameter, a list of rules.
+func parseLifecycle(val interface{}) ([]lifecycleRule, error) {
+	rules := []lifecycleRule{}
+	if err := decodeParam(LIFECYCLE, val, &rules); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, retErrInfof("Error: invalid %q rule %d: %v", LIFECYCLE, i, err)
+		}
+		if rules[i].ID == "" {
+			rules[i].ID = fmt.Sprintf("rule-%d", i)
+		}
+		if ids[rules[i].ID] {
+			return nil, retErrInfof("Error: %q rule id %q used more than once", LIFECYCLE, rules[i].ID)
+		}
+		ids[rules[i].ID] = true
+	}
+	return rules, nil
+}
+
+func (r *lifecycleRule) validate() error {
+	if r.ExpirationDays < 0 || r.NoncurrentVersionExpirationDays < 0 || r.AbortIncompleteMultipartDays < 0 {
+		return fmt.Errorf("days must be positive")
+	}
+	if r.ExpirationDays == 0 && r.NoncurrentVersionExpirationDays == 0 &&
+		len(r.Transitions) == 0 && r.AbortIncompleteMultipartDays == 0 {
+		return fmt.Errorf("rule has no action")
+	}
+	for _, t := range r.Transitions {
+		if t.Days < 0 {
+			return fmt.Errorf("transition days must not be negative")
+		}
+		if t.StorageClass == "" {
+			return fmt.Errorf("transition has no storage class")
+		}
+		if r.ExpirationDays > 0 && t.Days >= r.ExpirationDays {
+			return fmt.Errorf("transition to %s after %d days happens after expiration", t.StorageClass, t.Days)
+		}
+	}
+	return nil
+}
+
+func (r *lifecycleRule) s3Rule() *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(r.ID),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(r.Prefix)},
+	}
+	if r.ExpirationDays > 0 {
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(r.ExpirationDays)}
+	}
+	if r.NoncurrentVersionExpirationDays > 0 {
+		rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int64(r.NoncurrentVersionExpirationDays),
+		}
+	}
+	for _, t := range r.Transitions {
+		rule.Transitions = append(rule.Transitions, &s3.Transition{
+			Days:         aws.Int64(t.Days),
+			StorageClass: aws.String(t.StorageClass),
+		})
+	}
+	if r.AbortIncompleteMultipartDays > 0 {
+		rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(r.AbortIncompleteMultipartDays),
+		}
+	}
+	return rule
+}
+
+// Sets the lifecycle configuration of the bucket, removing it if there are no
+// rules.
+func (c *RGWClient) setBucketLifecycle(bucketName string, rules []lifecycleRule) error {
+	glog.Infof("Setting %d lifecycle rules on bucket %q", len(rules), bucketName)
+
+	if len(rules) == 0 {
+		_, err := c.client.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{
+			Bucket: &bucketName,
+		})
+		if err != nil {
+			return retErrInfof("Error removing lifecycle of bucket %s: %v", bucketName, err)
+		}
+		return nil
+	}
+
+	config := &s3.BucketLifecycleConfiguration{}
+	for i := range rules {
+		config.Rules = append(config.Rules, rules[i].s3Rule())
+	}
+
+	_, err := c.client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 &bucketName,
+		LifecycleConfiguration: config,
+	})
+	if err != nil {
+		return retErrInfof("Error setting lifecycle of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseLifecycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    []lifecycleRule
+		wantErr bool
+	}{
+		{
+			name:  "rules",
+			param: `[{"id":"tmp","prefix":"tmp/","expirationDays":30,"transitions":[{"days":7,"storageClass":"COLD"}]},{"abortIncompleteMultipartDays":2}]`,
+			want: []lifecycleRule{
+				{ID: "tmp", Prefix: "tmp/", ExpirationDays: 30, Transitions: []lifecycleTransition{{Days: 7, StorageClass: "COLD"}}},
+				{ID: "rule-1", AbortIncompleteMultipartDays: 2},
+			},
+		},
+		{name: "empty list", param: `[]`, want: []lifecycleRule{}},
+		{name: "noncurrent versions", param: `[{"noncurrentVersionExpirationDays":30}]`, want: []lifecycleRule{{ID: "rule-0", NoncurrentVersionExpirationDays: 30}}},
+		{name: "not a list", param: `{"expirationDays":7}`, wantErr: true},
+		{name: "unknown field", param: `[{"expirationDays":7,"days":7}]`, wantErr: true},
+		{name: "wrong type", param: `[{"expirationDays":"7"}]`, wantErr: true},
+		{name: "no action", param: `[{"prefix":"tmp/"}]`, wantErr: true},
+		{name: "negative days", param: `[{"expirationDays":-1}]`, wantErr: true},
+		{name: "negative transition days", param: `[{"transitions":[{"days":-1,"storageClass":"COLD"}]}]`, wantErr: true},
+		{name: "no storage class", param: `[{"transitions":[{"days":7}]}]`, wantErr: true},
+		{name: "transition after expiration", param: `[{"expirationDays":7,"transitions":[{"days":7,"storageClass":"COLD"}]}]`, wantErr: true},
+		{name: "duplicate ids", param: `[{"id":"a","expirationDays":7},{"id":"a","expirationDays":30}]`, wantErr: true},
+		{name: "id clashing with a default id", param: `[{"expirationDays":7},{"id":"rule-0","expirationDays":30}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var val interface{}
+			if err := json.Unmarshal([]byte(tt.param), &val); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseLifecycle(val)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseLifecycle(%s) = %+v, want an error", tt.param, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLifecycle(%s) failed: %v", tt.param, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLifecycle(%s) = %+v, want %+v", tt.param, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serialises the changes to the shared bucket policy
+const SHARED_BUCKET_LOCK = "shared-bucket"
+
+// lockManager serialises the operations on the same keys, e.g. the instance
+// ids, across the broker replicas.
+type lockManager interface {
+	// Blocks until the key is locked, or fails once the lock timeout is
+	// reached. The returned function releases the lock.
+	lock(key string) (func(), error)
+}
+
+// fileLocks is the lock manager of a single broker replica. It locks a file
+// per key in dir, so that the commands run in the broker pod, such as the
+// orphans command, lock the same keys as the running broker. A lock goes away
+// with the process holding it. The files are left in place, since removing a
+// file another process is waiting on would let a third one lock a new file of
+// the same name.
+type fileLocks struct {
+	dir     string
+	timeout time.Duration
+}
+
+func newFileLocks(dir string, timeout time.Duration) (*fileLocks, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory %s: %v", dir, err)
+	}
+	return &fileLocks{dir: dir, timeout: timeout}, nil
+}
+
+func (l *fileLocks) lock(key string) (func(), error) {
+	name := filepath.Join(l.dir, url.PathEscape(key))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock %s: %v", name, err)
+	}
+	deadline := time.Now().Add(l.timeout)
+	delay := 10 * time.Millisecond
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() {
+				// closing the file releases the lock
+				f.Close()
+			}, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("failed to take lock %s: %v", name, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, retErrInfof("Error: %s is busy with another operation, try again later", key)
+		}
+		time.Sleep(delay)
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// keyedLocks serialises the operations on the same keys within the broker,
+// while operations on different keys run in parallel.
+type keyedLocks struct {
+	lock  sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// operations holding or waiting for the lock
+	refs int
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*keyedLock)}
+}
+
+// Blocks until the key is locked. The returned function releases it.
+func (l *keyedLocks) acquire(key string) func() {
+	l.lock.Lock()
+	k, ok := l.locks[key]
+	if !ok {
+		k = &keyedLock{}
+		l.locks[key] = k
+	}
+	k.refs++
+	l.lock.Unlock()
+
+	k.Lock()
+	return func() {
+		k.Unlock()
+		l.lock.Lock()
+		k.refs--
+		if k.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.lock.Unlock()
+	}
+}
+
+func instanceLockKey(instanceID string) string {
+	return "instance-" + instanceID
+}
+
+func namespaceLockKey(namespace string) string {
+	return "namespace-" + namespace
+}
+
+// Locks the RGW user of a provision until its instance record is stored or the
+// user is rolled back, so that the orphan scanner can't take it for an orphan
+// meanwhile.
+func userLockKey(userName string) string {
+	return "user-" + userName
+}
+
+// Returns the keys of the bucket names, sorted so that provisions asking for
+// overlapping names lock them in the same order.
+func bucketLockKeys(names []string) []string {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, "bucket-"+name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the keys locked by the operations that create or remove instances
+// and bindings, which include the namespace since they change its usage
+// record.
+func (b *broker) instanceLockKeys(instanceID, namespace string) []string {
+	return []string{instanceLockKey(instanceID), namespaceLockKey(namespace)}
+}
+
+// Locks the keys within the broker, then across the replicas in HA mode, or
+// across the processes of the broker pod otherwise. The keys are locked in the
+// given order, which callers keep as instance, then namespace, then bucket
+// names, then user, then shared bucket, so that operations can't deadlock. The
+// returned function releases them.
+func (b *broker) lock(keys ...string) (func(), error) {
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, key := range keys {
+		unlocks = append(unlocks, b.keyedLocks.acquire(key))
+		u, err := b.locks.lock(key)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
+
+// Returns a copy of the cached record of an instance, which the caller may
+// change without racing with the readers of the cache.
+func (b *broker) cachedInstance(instanceID string) (*rgwServiceInstance, bool) {
+	b.mapLock.RLock()
+	defer b.mapLock.RUnlock()
+	instance, ok := b.instanceMap[instanceID]
+	if !ok {
+		return nil, false
+	}
+	c := *instance
+	return &c, true
+}
+
+func (b *broker) cacheInstance(instanceID string, instance *rgwServiceInstance) {
+	b.mapLock.Lock()
+	defer b.mapLock.Unlock()
+	b.instanceMap[instanceID] = instance
+}
+
+func (b *broker) forgetInstance(instanceID string) {
+	b.mapLock.Lock()
+	defer b.mapLock.Unlock()
+	delete(b.instanceMap, instanceID)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyedLocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		held     string
+		key      string
+		wantWait bool
+	}{
+		{name: "same key waits", held: "instance-a", key: "instance-a", wantWait: true},
+		{name: "other key runs", held: "instance-a", key: "instance-b", wantWait: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newKeyedLocks()
+			release := l.acquire(tt.held)
+
+			acquired := make(chan func())
+			go func() {
+				acquired <- l.acquire(tt.key)
+			}()
+
+			var second func()
+			select {
+			case second = <-acquired:
+				if tt.wantWait {
+					t.Fatalf("acquire(%q) didn't wait for the held lock", tt.key)
+				}
+			case <-time.After(50 * time.Millisecond):
+				if !tt.wantWait {
+					t.Fatalf("acquire(%q) waited for the lock of %q", tt.key, tt.held)
+				}
+			}
+
+			release()
+			if second == nil {
+				select {
+				case second = <-acquired:
+				case <-time.After(time.Second):
+					t.Fatalf("acquire(%q) wasn't granted once the lock was released", tt.key)
+				}
+			}
+			second()
+
+			if len(l.locks) != 0 {
+				t.Errorf("%d locks left once all were released", len(l.locks))
+			}
+		})
+	}
+}
+
+func TestFileLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgw-broker-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two lock managers on the same directory stand for the broker and a
+	// command run in its pod
+	running, err := newFileLocks(dir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := newFileLocks(dir, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := running.lock(instanceLockKey("a/b"))
+	if err != nil {
+		t.Fatalf("lock() failed: %v", err)
+	}
+	if _, err := command.lock(instanceLockKey("a/b")); err == nil {
+		t.Fatalf("lock() succeeded on a key locked by another lock manager")
+	}
+	other, err := command.lock(instanceLockKey("c"))
+	if err != nil {
+		t.Fatalf("lock() of another key failed: %v", err)
+	}
+	other()
+
+	release()
+	again, err := command.lock(instanceLockKey("a/b"))
+	if err != nil {
+		t.Fatalf("lock() failed once the lock was released: %v", err)
+	}
+	again()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// bucketNamePolicy decides which bucket names instances may use. It is
+// configured through the RGW_BUCKET_NAME_* environment variables.
+type bucketNamePolicy struct {
+	// template applied to the requested (or generated) bucket name, e.g.
+	// "{{namespace}}-{{name}}", empty to use the name as is
+	template string
+	// names that can never be used, the broker's own buckets are always
+	// reserved
+	reserved map[string]bool
+	// when not empty, bucket names must start with one of these
+	allowedPrefixes []string
+	// bucket names must not start with any of these
+	deniedPrefixes []string
+}
+
+func newBucketNamePolicy() *bucketNamePolicy {
+	return &bucketNamePolicy{
+		reserved: make(map[string]bool),
+	}
+}
+
+// Splits a comma separated list, dropping empty entries.
+func splitList(val string) []string {
+	var list []string
+	for _, s := range strings.Split(val, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Applies the naming template to the requested bucket name.
+func (p *bucketNamePolicy) expand(name, namespace, instanceID string) string {
+	if p.template == "" {
+		return name
+	}
+	r := strings.NewReplacer(
+		"{{namespace}}", namespace,
+		"{{name}}", name,
+		"{{instance}}", instanceID,
+	)
+	return strings.ToLower(r.Replace(p.template))
+}
+
+// Checks the bucket name against the S3 naming rules and the configured
+// reserved names and prefixes.
+func (p *bucketNamePolicy) check(name string) error {
+	if err := validBucketName(name); err != nil {
+		return err
+	}
+	if p.reserved[name] {
+		return retErrInfof("Error: bucket name %q is reserved", name)
+	}
+	for _, prefix := range p.deniedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return retErrInfof("Error: bucket name %q uses the denied prefix %q", name, prefix)
+		}
+	}
+	if len(p.allowedPrefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range p.allowedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return nil
+		}
+	}
+	return retErrInfof("Error: bucket name %q must start with one of %v", name, p.allowedPrefixes)
+}
+
+// Checks that the name is a valid S3 bucket name that can also be used as a
+// DNS label, so that virtual host style access works.
+func validBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return retErrInfof("Error: bucket name %q must be between 3 and 63 characters long", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '.' && c != '-' {
+			return retErrInfof("Error: bucket name %q may only contain lowercase letters, numbers, dots and hyphens", name)
+		}
+	}
+	if !isAlphaNum(name[0]) || !isAlphaNum(name[len(name)-1]) {
+		return retErrInfof("Error: bucket name %q must start and end with a letter or a number", name)
+	}
+	if strings.Contains(name, "..") || strings.Contains(name, ".-") || strings.Contains(name, "-.") {
+		return retErrInfof("Error: bucket name %q has an empty or invalid label", name)
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return retErrInfof("Error: bucket name %q must not be formatted as an IP address", name)
+	}
+	if strings.HasPrefix(name, "xn--") {
+		return retErrInfof("Error: bucket name %q must not start with \"xn--\"", name)
+	}
+	return nil
+}
+
+func isAlphaNum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+}
+
+// Checks every bucket name against the naming policy, and makes sure that none
+// of them exists yet. This runs before any RGW user is created, so that a bad
+// name doesn't leave an orphaned user behind.
+func (b *broker) checkBucketNames(rgw *RGWClient, names []string) error {
+	for _, name := range names {
+		if err := b.naming.check(name); err != nil {
+			return err
+		}
+
+		var status int
+		_, err := rgw.getBucketEntrypoint(name, &status)
+		switch {
+		case status == http.StatusNotFound:
+			glog.Infof("Bucket name %q is available", name)
+		case err != nil:
+			return err
+		default:
+			return retErrInfof("Error: bucket %q already exists", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBucketNamePolicyCheck(t *testing.T) {
+	policy := &bucketNamePolicy{
+		reserved:        map[string]bool{"kube-rgw-data": true},
+		allowedPrefixes: []string{"team-", "kube-"},
+		deniedPrefixes:  []string{"team-admin"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  *bucketNamePolicy
+		bucket  string
+		wantErr bool
+	}{
+		{name: "valid", policy: newBucketNamePolicy(), bucket: "my-bucket.v1"},
+		{name: "shortest", policy: newBucketNamePolicy(), bucket: "abc"},
+		{name: "longest", policy: newBucketNamePolicy(), bucket: strings.Repeat("a", 63)},
+		{name: "too short", policy: newBucketNamePolicy(), bucket: "ab", wantErr: true},
+		{name: "too long", policy: newBucketNamePolicy(), bucket: strings.Repeat("a", 64), wantErr: true},
+		{name: "uppercase", policy: newBucketNamePolicy(), bucket: "MyBucket", wantErr: true},
+		{name: "underscore", policy: newBucketNamePolicy(), bucket: "my_bucket", wantErr: true},
+		{name: "starts with hyphen", policy: newBucketNamePolicy(), bucket: "-bucket", wantErr: true},
+		{name: "ends with dot", policy: newBucketNamePolicy(), bucket: "bucket.", wantErr: true},
+		{name: "empty label", policy: newBucketNamePolicy(), bucket: "my..bucket", wantErr: true},
+		{name: "hyphen next to dot", policy: newBucketNamePolicy(), bucket: "my-.bucket", wantErr: true},
+		{name: "dot next to hyphen", policy: newBucketNamePolicy(), bucket: "my.-bucket", wantErr: true},
+		{name: "ip address", policy: newBucketNamePolicy(), bucket: "192.168.1.1", wantErr: true},
+		{name: "punycode", policy: newBucketNamePolicy(), bucket: "xn--bucket", wantErr: true},
+		{name: "reserved", policy: policy, bucket: "kube-rgw-data", wantErr: true},
+		{name: "allowed prefix", policy: policy, bucket: "team-data"},
+		{name: "other allowed prefix", policy: policy, bucket: "kube-data"},
+		{name: "not an allowed prefix", policy: policy, bucket: "data", wantErr: true},
+		{name: "denied prefix", policy: policy, bucket: "team-admin-data", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.bucket)
+			if tt.wantErr && err == nil {
+				t.Errorf("check(%q) succeeded, want an error", tt.bucket)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("check(%q) = %v, want no error", tt.bucket, err)
+			}
+		})
+	}
+}
+
+func TestBucketNamePolicyExpand(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "", want: "Data"},
+		{template: "{{namespace}}-{{name}}", want: "team-a-data"},
+		{template: "{{instance}}", want: "abc123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			p := &bucketNamePolicy{template: tt.template}
+			if got := p.expand("Data", "team-a", "abc123"); got != tt.want {
+				t.Errorf("expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	NOTIFICATIONS = "notifications"
+
+	// id of the notification the broker sets on the instance buckets
+	notificationID = "rgw-broker"
+)
+
+var notificationSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"amqp":  true,
+	"amqps": true,
+	"kafka": true,
+}
+
+// topic attributes that may be given in the "notifications" parameter. The
+// others, such as "verify-ssl" or "ca-location", are left to the RGW defaults.
+var notificationAttributes = []string{
+	"amqp-exchange",
+	"amqp-ack-level",
+	"kafka-ack-level",
+	"use-ssl",
+	"persistent",
+	"cloudevents",
+	"OpaqueData",
+}
+
+// notificationConfig describes the topic the instance bucket events are sent
+// to, as accepted in the "notifications" parameter.
+type notificationConfig struct {
+	// push endpoint of the topic, http(s), amqp(s) or kafka
+	Endpoint string `json:"endpoint"`
+	// defaults to all the object created events
+	Events []string `json:"events,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Suffix string   `json:"suffix,omitempty"`
+	// additional topic attributes, e.g. "amqp-exchange" or "kafka-ack-level"
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Parses and validates the "notifications" parameter, returns nil if it wasn't
+// given. The endpoint must be on one of the hosts listed in
+// RGW_NOTIFICATION_HOSTS, since RGW pushes the events from inside the cluster.
+func (b *broker) parseNotifications(params map[string]interface{}) (*notificationConfig, error) {
+	val, ok := params[NOTIFICATIONS]
+	if !ok {
+		return nil, nil
+	}
+
+	n := &notificationConfig{}
+	if err := decodeParam(NOTIFICATIONS, val, n); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(n.Endpoint)
+	if err != nil || u.Host == "" || !notificationSchemes[u.Scheme] {
+		return nil, retErrInfof("Error: %q endpoint %q must be a http(s), amqp(s) or kafka url", NOTIFICATIONS, n.Endpoint)
+	}
+	if !b.notificationHostAllowed(u) {
+		return nil, retErrInfof("Error: %q endpoint host %q is not allowed", NOTIFICATIONS, u.Host)
+	}
+	if len(n.Events) == 0 {
+		n.Events = []string{"s3:ObjectCreated:*"}
+	}
+	for _, event := range n.Events {
+		if !strings.HasPrefix(event, "s3:") {
+			return nil, retErrInfof("Error: %q has invalid event %q", NOTIFICATIONS, event)
+		}
+	}
+	for key := range n.Attributes {
+		if !stringInList(key, notificationAttributes) {
+			return nil, retErrInfof("Error: %q attribute %q is not allowed, expected one of %v", NOTIFICATIONS, key, notificationAttributes)
+		}
+	}
+	return n, nil
+}
+
+// Checks the host of a push endpoint against the allowed hosts, which are
+// either a host name, a "<host>:<port>" pair or a "*.<domain>" wildcard.
+func (b *broker) notificationHostAllowed(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range b.notificationHosts {
+		allowed = strings.ToLower(allowed)
+		switch {
+		case strings.HasPrefix(allowed, "*."):
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		case strings.Contains(allowed, ":"):
+			if strings.ToLower(u.Host) == allowed {
+				return true
+			}
+		case host == allowed:
+			return true
+		}
+	}
+	return false
+}
+
+func stringInList(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the topic of an instance.
+func topicName(instanceID string) string {
+	return "rgw-broker-" + instanceID
+}
+
+type createTopicResponse struct {
+	TopicArn string `xml:"CreateTopicResult>TopicArn"`
+}
+
+// Sends a request to the SNS compatible topic API of RGW.
+func (c *RGWClient) snsRequest(params url.Values) ([]byte, error) {
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: http.DefaultTransport,
+	}
+
+	body := []byte(params.Encode())
+	req, err := http.NewRequest("POST", c.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating topic request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	user, _ := c.credentials()
+	s := v4.NewSigner(credentials.NewStaticCredentials(user.accessKey, user.secret, ""))
+	if _, err := s.Sign(req, bytes.NewReader(body), "sns", "default", time.Now()); err != nil {
+		return nil, fmt.Errorf("Error signing topic request: %v", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending topic request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading topic response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return data, fmt.Errorf("Error %s: got http response %v: %s", params.Get("Action"), resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// Creates the topic, or updates it if it already exists, and returns its ARN.
+func (c *RGWClient) createTopic(name string, n *notificationConfig) (string, error) {
+	glog.Infof("Creating topic %q pushing to %s", name, n.Endpoint)
+
+	attrs := map[string]string{"push-endpoint": n.Endpoint}
+	for k, v := range n.Attributes {
+		attrs[k] = v
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := url.Values{}
+	params.Set("Action", "CreateTopic")
+	params.Set("Name", name)
+	for i, k := range keys {
+		entry := "Attributes.entry." + strconv.Itoa(i+1)
+		params.Set(entry+".key", k)
+		params.Set(entry+".value", attrs[k])
+	}
+
+	data, err := c.snsRequest(params)
+	if err != nil {
+		return "", retErrInfof("Error creating topic %s: %v", name, err)
+	}
+	resp := createTopicResponse{}
+	if err := xml.Unmarshal(data, &resp); err != nil || resp.TopicArn == "" {
+		return "", retErrInfof("Error: unexpected response creating topic %s: %s", name, string(data))
+	}
+	return resp.TopicArn, nil
+}
+
+// Removes the topic. Removing a topic that doesn't exist succeeds.
+func (c *RGWClient) deleteTopic(topicArn string) error {
+	glog.Infof("Removing topic %q", topicArn)
+
+	params := url.Values{}
+	params.Set("Action", "DeleteTopic")
+	params.Set("TopicArn", topicArn)
+
+	data, err := c.snsRequest(params)
+	if err != nil && !bytes.Contains(data, []byte("NotFound")) {
+		return retErrInfof("Error removing topic %s: %v", topicArn, err)
+	}
+	return nil
+}
+
+// Sends the events of the bucket to the topic, replacing any existing
+// notification configuration. A nil config removes the notifications.
+func (c *RGWClient) setBucketNotification(bucketName, topicArn string, n *notificationConfig) error {
+	config := &s3.NotificationConfiguration{}
+	if n != nil {
+		glog.Infof("Setting notifications of bucket %q to topic %q", bucketName, topicArn)
+
+		topic := &s3.TopicConfiguration{
+			Id:       aws.String(notificationID),
+			TopicArn: aws.String(topicArn),
+			Events:   aws.StringSlice(n.Events),
+		}
+		var rules []*s3.FilterRule
+		if n.Prefix != "" {
+			rules = append(rules, &s3.FilterRule{Name: aws.String("prefix"), Value: aws.String(n.Prefix)})
+		}
+		if n.Suffix != "" {
+			rules = append(rules, &s3.FilterRule{Name: aws.String("suffix"), Value: aws.String(n.Suffix)})
+		}
+		if len(rules) > 0 {
+			topic.Filter = &s3.NotificationConfigurationFilter{Key: &s3.KeyFilter{FilterRules: rules}}
+		}
+		config.TopicConfigurations = []*s3.TopicConfiguration{topic}
+	} else {
+		glog.Infof("Removing notifications of bucket %q", bucketName)
+	}
+
+	_, err := c.client.PutBucketNotificationConfiguration(&s3.PutBucketNotificationConfigurationInput{
+		Bucket:                    &bucketName,
+		NotificationConfiguration: config,
+	})
+	if err != nil {
+		return retErrInfof("Error setting notifications of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	RETENTION = "retention"
+)
+
+// objectRetention is the default retention of the objects written to an Object
+// Lock enabled bucket, as accepted in the "retention" parameter. Exactly one of
+// Days and Years is set.
+type objectRetention struct {
+	Mode  string `json:"mode"`
+	Days  int64  `json:"days,omitempty"`
+	Years int64  `json:"years,omitempty"`
+}
+
+// Parses and validates the "retention" parameter. Only the compliance plan
+// takes it, and GOVERNANCE mode would let users with the bypass permission
+// delete objects under retention, so the mode must be COMPLIANCE.
+func parseRetention(val interface{}) (*objectRetention, error) {
+	r := &objectRetention{}
+	if err := decodeParam(RETENTION, val, r); err != nil {
+		return nil, err
+	}
+	if r.Mode != s3.ObjectLockRetentionModeCompliance {
+		return nil, retErrInfof("Error: %q mode must be %q", RETENTION, s3.ObjectLockRetentionModeCompliance)
+	}
+	if (r.Days > 0) == (r.Years > 0) || r.Days < 0 || r.Years < 0 {
+		return nil, retErrInfof("Error: %q needs a positive number of either days or years", RETENTION)
+	}
+	return r, nil
+}
+
+// Returns how long an object written now stays under retention.
+func (r *objectRetention) period() time.Duration {
+	days := r.Days + r.Years*366
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Sets the default retention of an Object Lock enabled bucket.
+func (c *RGWClient) setBucketRetention(bucketName string, r *objectRetention) error {
+	glog.Infof("Setting default retention of bucket %q to %s %d days %d years", bucketName, r.Mode, r.Days, r.Years)
+
+	retention := &s3.DefaultRetention{Mode: aws.String(r.Mode)}
+	if r.Days > 0 {
+		retention.Days = aws.Int64(r.Days)
+	} else {
+		retention.Years = aws.Int64(r.Years)
+	}
+
+	_, err := c.client.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+		Bucket: &bucketName,
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule:              &s3.ObjectLockRule{DefaultRetention: retention},
+		},
+	})
+	if err != nil {
+		return retErrInfof("Error setting object lock configuration of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+// rgwParkedBucket records an Object Lock enabled bucket parked under the gc
+// user. Objects written before the bucket was parked may stay under retention
+// until RetainUntil, and the bucket must not be purged before then.
+type rgwParkedBucket struct {
+	Backend     string
+	BucketName  string
+	InstanceID  string
+	ParkedAt    time.Time
+	RetainUntil time.Time
+}
+
+func getParkedOid(backend, bucketName string) string {
+	if backend == "" {
+		backend = DEFAULT_BACKEND
+	}
+	return "gc/" + backend + "/" + bucketName
+}
+
+// Records that a bucket of the instance is parked under the gc user. The
+// retention is the longest the instance buckets ever had, since objects written
+// under it keep it, and an existing record is never shortened.
+func (b *broker) storeParkedBucket(instanceID string, instance *rgwServiceInstance, bucketName string) error {
+	now := time.Now().UTC()
+	info := rgwParkedBucket{
+		Backend:     instance.Backend,
+		BucketName:  bucketName,
+		InstanceID:  instanceID,
+		ParkedAt:    now,
+		RetainUntil: now,
+	}
+	if r := instance.longestRetention(); r != nil {
+		info.RetainUntil = now.Add(r.period())
+	}
+
+	old, err := b.getParkedBucket(instance.Backend, bucketName)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.RetainUntil.After(info.RetainUntil) {
+		info.RetainUntil = old.RetainUntil
+	}
+	glog.Infof("Parking bucket %q under retention until %v", bucketName, info.RetainUntil)
+	return b.storeInfo(getParkedOid(instance.Backend, bucketName), info)
+}
+
+// Returns the retention record of a parked bucket, or nil if there is none.
+func (b *broker) getParkedBucket(backend, bucketName string) (*rgwParkedBucket, error) {
+	oid := getParkedOid(backend, bucketName)
+	_, err := b.rgw.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &b.dataBucket,
+		Key:    &oid,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the retention record of bucket %q: %v", bucketName, err)
+	}
+
+	info := new(rgwParkedBucket)
+	if err := b.readInfo(oid, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Refuses to purge a bucket whose objects may still be under retention, that is
+// to delete it, or to move it anywhere but back under the gc user with its
+// retention record. Buckets that were not parked with a retention record can
+// be purged.
+func (b *broker) checkPurgeAllowed(backend, bucketName string) error {
+	info, err := b.getParkedBucket(backend, bucketName)
+	if err != nil {
+		return err
+	}
+	if info != nil && time.Now().Before(info.RetainUntil) {
+		return retErrInfof("Error: bucket %q may hold objects under retention until %v", bucketName, info.RetainUntil)
+	}
+	return nil
+}
+
+// Returns the longest default retention the instance buckets ever had, nil if
+// they never had one.
+func (i *rgwServiceInstance) longestRetention() *objectRetention {
+	r := i.LongestRetention
+	if r == nil || (i.Retention != nil && i.Retention.period() > r.period()) {
+		r = i.Retention
+	}
+	return r
+}
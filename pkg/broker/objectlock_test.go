@@ -0,0 +1,170 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    objectRetention
+		wantErr bool
+	}{
+		{name: "days", param: `{"mode":"COMPLIANCE","days":90}`, want: objectRetention{Mode: "COMPLIANCE", Days: 90}},
+		{name: "years", param: `{"mode":"COMPLIANCE","years":7}`, want: objectRetention{Mode: "COMPLIANCE", Years: 7}},
+		{name: "governance mode", param: `{"mode":"GOVERNANCE","days":90}`, wantErr: true},
+		{name: "no mode", param: `{"days":90}`, wantErr: true},
+		{name: "no period", param: `{"mode":"COMPLIANCE"}`, wantErr: true},
+		{name: "days and years", param: `{"mode":"COMPLIANCE","days":90,"years":1}`, wantErr: true},
+		{name: "negative days", param: `{"mode":"COMPLIANCE","days":-1}`, wantErr: true},
+		{name: "unknown field", param: `{"mode":"COMPLIANCE","days":90,"months":1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var val interface{}
+			if err := json.Unmarshal([]byte(tt.param), &val); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseRetention(val)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseRetention(%s) = %+v, want an error", tt.param, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRetention(%s) failed: %v", tt.param, err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseRetention(%s) = %+v, want %+v", tt.param, *got, tt.want)
+			}
+		})
+	}
+}
+
+// Serves the data bucket of a test broker, keeping the objects in memory.
+// Objects can be read, written and removed, but not listed.
+type fakeDataBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// Starts a server for the data bucket holding the objects, encoded as JSON,
+// and returns a broker using it.
+func newFakeDataBucket(t *testing.T, objects map[string]interface{}) (*fakeDataBucket, *broker, func()) {
+	d := &fakeDataBucket{objects: make(map[string][]byte)}
+	for oid, obj := range objects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.objects[oid] = data
+	}
+	server := httptest.NewServer(d)
+	client, err := getS3Client("test", credentials.NewStaticCredentials("test", "test", ""), server.URL, "us-east-1")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return d, &broker{rgw: &RGWClient{client: client}, dataBucket: "kube-rgw-data"}, server.Close
+}
+
+func (d *fakeDataBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	oid := strings.TrimPrefix(r.URL.Path, "/kube-rgw-data/")
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		d.objects[oid] = data
+	case "DELETE":
+		delete(d.objects, oid)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		data, ok := d.objects[oid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}
+}
+
+// Decodes the object into dst, returning false if there is no such object.
+func (d *fakeDataBucket) get(t *testing.T, oid string, dst interface{}) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.objects[oid]
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, dst); err != nil {
+		t.Fatalf("failed to decode object %s: %v", oid, err)
+	}
+	return true
+}
+
+func TestCheckPurgeAllowed(t *testing.T) {
+	now := time.Now().UTC()
+	_, b, stop := newFakeDataBucket(t, map[string]interface{}{
+		"gc/default/retained": rgwParkedBucket{BucketName: "retained", ParkedAt: now, RetainUntil: now.Add(time.Hour)},
+		"gc/default/expired":  rgwParkedBucket{BucketName: "expired", ParkedAt: now.Add(-2 * time.Hour), RetainUntil: now.Add(-time.Hour)},
+		"gc/archive/retained": rgwParkedBucket{Backend: "archive", BucketName: "retained", ParkedAt: now, RetainUntil: now.Add(time.Hour)},
+	})
+	defer stop()
+
+	tests := []struct {
+		name    string
+		backend string
+		bucket  string
+		wantErr bool
+	}{
+		{name: "retained bucket", bucket: "retained", wantErr: true},
+		{name: "retained bucket on a backend", backend: "archive", bucket: "retained", wantErr: true},
+		{name: "expired retention", bucket: "expired"},
+		{name: "no record", bucket: "other"},
+		{name: "record on another backend", backend: "archive", bucket: "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.checkPurgeAllowed(tt.backend, tt.bucket)
+			if tt.wantErr && err == nil {
+				t.Errorf("checkPurgeAllowed(%q, %q) succeeded, want an error", tt.backend, tt.bucket)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("checkPurgeAllowed(%q, %q) = %v, want no error", tt.backend, tt.bucket, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,533 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	// actions of the orphan scanner
+	ORPHAN_REPORT     = "report"
+	ORPHAN_QUARANTINE = "quarantine"
+	ORPHAN_DELETE     = "delete"
+
+	// orphans changed more recently may belong to operations in flight
+	DEFAULT_ORPHAN_MIN_AGE = 24 * time.Hour
+
+	// results of the scanner for an orphan
+	ORPHAN_FOUND      = "found"
+	ORPHAN_TOO_RECENT = "too recent"
+	ORPHAN_SUSPENDED  = "suspended"
+	ORPHAN_REMOVED    = "removed"
+	ORPHAN_PARKED     = "parked"
+	ORPHAN_FAILED     = "failed"
+
+	// layout of the mtime of the RGW metadata entries
+	rgwMtimeLayout = "2006-01-02 15:04:05.999999999Z"
+)
+
+// OrphanUser is an RGW user named like the broker users with no instance
+// record.
+type OrphanUser struct {
+	Backend  string    `json:"backend"`
+	UserName string    `json:"rgwUser"`
+	Modified time.Time `json:"modified"`
+	Buckets  []string  `json:"buckets,omitempty"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// OrphanKey is an access key of an instance user that no binding record holds.
+type OrphanKey struct {
+	Backend    string    `json:"backend"`
+	InstanceID string    `json:"instanceId"`
+	UserName   string    `json:"rgwUser"`
+	AccessKey  string    `json:"accessKey"`
+	Modified   time.Time `json:"modified"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// OrphanBucket is a bucket owned by an instance user that is not one of the
+// instance buckets.
+type OrphanBucket struct {
+	Backend    string    `json:"backend"`
+	InstanceID string    `json:"instanceId"`
+	Owner      string    `json:"rgwUser"`
+	Bucket     string    `json:"bucket"`
+	Modified   time.Time `json:"modified"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// OrphanReport lists the orphans found by a scan, and what was done with them.
+type OrphanReport struct {
+	Time    time.Time      `json:"time"`
+	Action  string         `json:"action"`
+	MinAge  string         `json:"minAge"`
+	Users   []OrphanUser   `json:"users"`
+	Keys    []OrphanKey    `json:"keys"`
+	Buckets []OrphanBucket `json:"buckets"`
+}
+
+// Implements the `ScanOrphans` interface method. Every RGW user named with the
+// broker uid prefix is checked against the instance and binding records:
+//
+//   - users no instance record holds, on any backend, are suspended by
+//     quarantine, and removed by delete after their buckets are parked under
+//     the gc user,
+//   - access keys of instance users that are neither the provisioning key nor
+//     held by a binding are removed by delete,
+//   - buckets of instance users that are not instance buckets are parked under
+//     the gc user by delete.
+//
+// Orphans whose RGW metadata changed less than minAge ago are only reported,
+// since they may belong to operations in flight. minAge can't be below the
+// configured floor. The changes lock the instance, or the user of an orphan
+// user, through the same lock manager as the running broker.
+func (b *broker) ScanOrphans(action string, minAge time.Duration) (*OrphanReport, error) {
+	glog.Infof("ScanOrphans called. action: %s minAge: %v", action, minAge)
+	switch action {
+	case ORPHAN_REPORT, ORPHAN_QUARANTINE, ORPHAN_DELETE:
+	default:
+		return nil, retErrInfof("Error: invalid orphan action %q, expected %q, %q or %q", action, ORPHAN_REPORT, ORPHAN_QUARANTINE, ORPHAN_DELETE)
+	}
+	if minAge < b.orphanMinAgeFloor {
+		return nil, retErrInfof("Error: orphan minimum age %v is below the floor of %v", minAge, b.orphanMinAgeFloor)
+	}
+	if b.uidPrefix == "" {
+		return nil, retErrInfof("Error: orphans can't be told apart from other users without a uid prefix")
+	}
+
+	instances, err := b.listInstances()
+	if err != nil {
+		return nil, err
+	}
+	bindingKeys, err := b.listBindingKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// instance ids by user, across the backends: backends sharing their
+	// metadata list the users of each other, which are not orphans
+	tracked := make(map[string]string)
+	for id, instance := range instances {
+		tracked[instance.UserName] = id
+	}
+
+	s := &orphanScan{
+		b:           b,
+		action:      action,
+		cutoff:      time.Now().Add(-minAge),
+		bindingKeys: bindingKeys,
+		report: &OrphanReport{
+			Time:    time.Now().UTC(),
+			Action:  action,
+			MinAge:  minAge.String(),
+			Users:   []OrphanUser{},
+			Keys:    []OrphanKey{},
+			Buckets: []OrphanBucket{},
+		},
+	}
+
+	names := make([]string, 0, len(b.backends))
+	for name := range b.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rgw := b.backends[name]
+		users, err := rgw.listUsers()
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(users)
+		for _, uid := range users {
+			if !strings.HasPrefix(uid, b.uidPrefix) || uid == b.gcUser {
+				continue
+			}
+			id, ok := tracked[uid]
+			if !ok {
+				s.scanUser(rgw, uid)
+			} else if instanceBackendName(instances[id]) == name {
+				s.scanInstanceUser(rgw, id, instances[id])
+			}
+		}
+	}
+	return s.report, nil
+}
+
+// orphanScan is the state of a scan.
+type orphanScan struct {
+	b      *broker
+	action string
+	// orphans changed after cutoff are left alone
+	cutoff time.Time
+	// access keys of the bindings of each instance
+	bindingKeys map[string]map[string]bool
+	report      *OrphanReport
+}
+
+// Returns whether the action may be applied to an orphan last changed at
+// modified, setting the result otherwise.
+func (s *orphanScan) actionable(modified time.Time, result *string) bool {
+	switch {
+	case s.action == ORPHAN_REPORT:
+		*result = ORPHAN_FOUND
+	case modified.IsZero() || modified.After(s.cutoff):
+		*result = ORPHAN_TOO_RECENT
+	default:
+		return true
+	}
+	return false
+}
+
+// Handles a user with no instance record.
+func (s *orphanScan) scanUser(rgw *RGWClient, uid string) {
+	u := OrphanUser{Backend: rgw.backend, UserName: uid}
+	defer func() {
+		s.report.Users = append(s.report.Users, u)
+	}()
+
+	var err error
+	if u.Modified, err = rgw.metadataMtime("user:" + uid); err != nil {
+		u.Result, u.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	if u.Buckets, err = rgw.listUserBuckets(uid); err != nil {
+		u.Result, u.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	if !s.actionable(u.Modified, &u.Result) {
+		return
+	}
+
+	// a provision in flight holds the lock of its user until its instance
+	// record is stored, or the user is rolled back
+	unlock, err := s.b.lock(userLockKey(uid))
+	if err != nil {
+		u.Result, u.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	defer unlock()
+	tracked, err := s.b.userTracked(uid)
+	if err != nil {
+		u.Result, u.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	if tracked {
+		// provisioned since the records were listed
+		u.Result = ORPHAN_TOO_RECENT
+		return
+	}
+
+	glog.Infof("Orphan user %s on backend %q: %s", uid, rgw.backend, s.action)
+	if err := rgw.suspendUser(uid); err != nil {
+		u.Result, u.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	u.Result = ORPHAN_SUSPENDED
+	if s.action != ORPHAN_DELETE {
+		return
+	}
+	// the user has no instance record to park its buckets with a retention
+	// record, so a bucket still under one must stay where it is
+	for _, bucket := range u.Buckets {
+		if err := s.b.checkPurgeAllowed(rgw.backend, bucket); err != nil {
+			u.Result, u.Error = ORPHAN_FAILED, err.Error()
+			return
+		}
+	}
+	for _, bucket := range u.Buckets {
+		if err := moveBucket(rgw, uid, bucket, s.b.gcUser); err != nil {
+			u.Result, u.Error = ORPHAN_FAILED, err.Error()
+			return
+		}
+	}
+	if err := rgw.removeUser(uid); err != nil {
+		u.Result, u.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	u.Result = ORPHAN_REMOVED
+}
+
+// Looks for the keys and buckets of an instance user that the instance
+// doesn't account for.
+func (s *orphanScan) scanInstanceUser(rgw *RGWClient, instanceID string, instance *rgwServiceInstance) {
+	modified, err := rgw.metadataMtime("user:" + instance.UserName)
+	if err != nil {
+		glog.Errorf("Failed to scan user %s of instance %s: %v", instance.UserName, instanceID, err)
+		return
+	}
+
+	// instances created before the provisioning key was recorded have a key
+	// that can't be told apart from orphan keys
+	if instance.Prefix == "" && instance.ProvisioningKey == "" {
+		glog.Infof("Not scanning the keys of instance %s, its provisioning key is not recorded", instanceID)
+	} else if info, err := rgw.getUserInfo(instance.UserName); err != nil {
+		glog.Errorf("Failed to scan the keys of instance %s: %v", instanceID, err)
+	} else {
+		for _, key := range info.Keys {
+			if key.AccessKey == instance.ProvisioningKey || s.bindingKeys[instanceID][key.AccessKey] {
+				continue
+			}
+			s.handleKey(rgw, instanceID, instance, OrphanKey{
+				Backend:    rgw.backend,
+				InstanceID: instanceID,
+				UserName:   instance.UserName,
+				AccessKey:  key.AccessKey,
+				Modified:   modified,
+			})
+		}
+	}
+
+	buckets, err := rgw.listUserBuckets(instance.UserName)
+	if err != nil {
+		glog.Errorf("Failed to scan the buckets of instance %s: %v", instanceID, err)
+		return
+	}
+	known := make(map[string]bool)
+	for _, name := range instance.bucketNames() {
+		known[name] = true
+	}
+	for _, bucket := range buckets {
+		if known[bucket] {
+			continue
+		}
+		o := OrphanBucket{
+			Backend:    rgw.backend,
+			InstanceID: instanceID,
+			Owner:      instance.UserName,
+			Bucket:     bucket,
+		}
+		if o.Modified, err = rgw.metadataMtime("bucket:" + bucket); err != nil {
+			o.Result, o.Error = ORPHAN_FAILED, err.Error()
+		} else {
+			s.handleBucket(rgw, instance, &o)
+		}
+		s.report.Buckets = append(s.report.Buckets, o)
+	}
+}
+
+// Removes an orphan key on delete. RGW can't suspend a single key, so
+// quarantine only reports it.
+func (s *orphanScan) handleKey(rgw *RGWClient, instanceID string, instance *rgwServiceInstance, k OrphanKey) {
+	defer func() {
+		s.report.Keys = append(s.report.Keys, k)
+	}()
+	if !s.actionable(k.Modified, &k.Result) {
+		return
+	}
+	if s.action != ORPHAN_DELETE {
+		k.Result = ORPHAN_FOUND
+		return
+	}
+
+	unlock, err := s.b.lock(instanceLockKey(instanceID))
+	if err != nil {
+		k.Result, k.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	defer unlock()
+	// a binding may have been created since the records were listed
+	keys, err := s.b.listBindingKeysOf(instanceID)
+	if err != nil {
+		k.Result, k.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	if keys[k.AccessKey] {
+		k.Result = ORPHAN_TOO_RECENT
+		return
+	}
+
+	glog.Infof("Removing orphan key %s of instance %s", k.AccessKey, instanceID)
+	if err := rgw.removeKey(instance.UserName, k.AccessKey); err != nil {
+		k.Result, k.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	k.Result = ORPHAN_REMOVED
+}
+
+// Parks an orphan bucket under the gc user on delete. The bucket of an Object
+// Lock instance is parked with the retention record of the instance buckets.
+func (s *orphanScan) handleBucket(rgw *RGWClient, instance *rgwServiceInstance, o *OrphanBucket) {
+	if !s.actionable(o.Modified, &o.Result) {
+		return
+	}
+	if s.action != ORPHAN_DELETE {
+		o.Result = ORPHAN_FOUND
+		return
+	}
+
+	unlock, err := s.b.lock(instanceLockKey(o.InstanceID))
+	if err != nil {
+		o.Result, o.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	defer unlock()
+
+	glog.Infof("Parking orphan bucket %s of instance %s", o.Bucket, o.InstanceID)
+	if instance.ObjectLock {
+		if err := s.b.storeParkedBucket(o.InstanceID, instance, o.Bucket); err != nil {
+			o.Result, o.Error = ORPHAN_FAILED, err.Error()
+			return
+		}
+	} else if err := s.b.checkPurgeAllowed(rgw.backend, o.Bucket); err != nil {
+		o.Result, o.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	if err := moveBucket(rgw, o.Owner, o.Bucket, s.b.gcUser); err != nil {
+		o.Result, o.Error = ORPHAN_FAILED, err.Error()
+		return
+	}
+	o.Result = ORPHAN_PARKED
+}
+
+// Returns whether an instance record holds the user, reading the records again
+// since the scan started.
+func (b *broker) userTracked(uid string) (bool, error) {
+	instances, err := b.listInstances()
+	if err != nil {
+		return false, err
+	}
+	for _, instance := range instances {
+		if instance.UserName == uid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the name of the backend holding the instance.
+func instanceBackendName(instance *rgwServiceInstance) string {
+	if instance.Backend == "" {
+		return DEFAULT_BACKEND
+	}
+	return instance.Backend
+}
+
+// Returns the access keys of the bindings of every instance.
+func (b *broker) listBindingKeys() (map[string]map[string]bool, error) {
+	return b.bindingKeys(getBindOid("", ""))
+}
+
+// Returns the access keys of the bindings of an instance.
+func (b *broker) listBindingKeysOf(instanceID string) (map[string]bool, error) {
+	keys, err := b.bindingKeys(getBindOid(instanceID, ""))
+	if err != nil {
+		return nil, err
+	}
+	return keys[instanceID], nil
+}
+
+// Reads the binding records under a prefix of the data bucket.
+func (b *broker) bindingKeys(prefix string) (map[string]map[string]bool, error) {
+	var oids []string
+	err := b.rgw.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &b.dataBucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			oids = append(oids, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, retErrInfof("Error listing bindings in %s: %v", b.dataBucket, err)
+	}
+
+	keys := make(map[string]map[string]bool)
+	for _, oid := range oids {
+		// bind/<instance id>/<binding id>
+		parts := strings.SplitN(strings.TrimPrefix(oid, getBindOid("", "")), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		info := new(rgwBindInfo)
+		if err := b.readInfo(oid, info); err != nil {
+			return nil, err
+		}
+		accessKey, _ := info.Credential[ACCESS_KEY].(string)
+		if keys[parts[0]] == nil {
+			keys[parts[0]] = make(map[string]bool)
+		}
+		keys[parts[0]][accessKey] = true
+	}
+	return keys, nil
+}
+
+// Lists the ids of all the RGW users.
+func (rgw *RGWClient) listUsers() ([]string, error) {
+	body, err := rgw.rgwAdminRequest("GET", "metadata/user", "", make(url.Values), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing users of backend %q: %v", rgw.backend, err)
+	}
+	var users []string
+	if err := json.Unmarshal(body, &users); err != nil {
+		return nil, fmt.Errorf("Error failed to unmarshal users of backend %q: %v", rgw.backend, err)
+	}
+	return users, nil
+}
+
+// Lists the names of the buckets owned by a user.
+func (rgw *RGWClient) listUserBuckets(uid string) ([]string, error) {
+	params := make(url.Values)
+	params.Set("uid", uid)
+	body, err := rgw.rgwAdminRequest("GET", "bucket", "", params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing buckets of user %s: %v", uid, err)
+	}
+	var buckets []string
+	if err := json.Unmarshal(body, &buckets); err != nil {
+		return nil, fmt.Errorf("Error failed to unmarshal buckets of user %s: %v", uid, err)
+	}
+	return buckets, nil
+}
+
+// Returns when a metadata entry, e.g. "user:<uid>" or "bucket:<name>", was
+// last changed.
+func (rgw *RGWClient) metadataMtime(key string) (time.Time, error) {
+	params := make(url.Values)
+	params.Set("key", key)
+	body, err := rgw.rgwAdminRequest("GET", "metadata", "", params, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error fetching metadata of %s: %v", key, err)
+	}
+	var entry struct {
+		Mtime string `json:"mtime"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("Error failed to unmarshal metadata of %s: %v", key, err)
+	}
+	mtime, err := time.Parse(rgwMtimeLayout, entry.Mtime)
+	if err != nil {
+		if mtime, err = time.Parse(time.RFC3339Nano, entry.Mtime); err != nil {
+			return time.Time{}, fmt.Errorf("Error invalid mtime %q of %s", entry.Mtime, key)
+		}
+	}
+	return mtime, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrphanScanActionable(t *testing.T) {
+	cutoff := time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC)
+	old := cutoff.Add(-time.Hour)
+	recent := cutoff.Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		action     string
+		modified   time.Time
+		want       bool
+		wantResult string
+	}{
+		{name: "report old", action: ORPHAN_REPORT, modified: old, want: false, wantResult: ORPHAN_FOUND},
+		{name: "report recent", action: ORPHAN_REPORT, modified: recent, want: false, wantResult: ORPHAN_FOUND},
+		{name: "quarantine old", action: ORPHAN_QUARANTINE, modified: old, want: true},
+		{name: "quarantine recent", action: ORPHAN_QUARANTINE, modified: recent, want: false, wantResult: ORPHAN_TOO_RECENT},
+		{name: "delete old", action: ORPHAN_DELETE, modified: old, want: true},
+		{name: "delete at cutoff", action: ORPHAN_DELETE, modified: cutoff, want: true},
+		{name: "delete recent", action: ORPHAN_DELETE, modified: recent, want: false, wantResult: ORPHAN_TOO_RECENT},
+		{name: "delete unknown mtime", action: ORPHAN_DELETE, want: false, wantResult: ORPHAN_TOO_RECENT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &orphanScan{action: tt.action, cutoff: cutoff}
+			var result string
+			if got := s.actionable(tt.modified, &result); got != tt.want {
+				t.Errorf("actionable() = %v, want %v", got, tt.want)
+			}
+			if result != tt.wantResult {
+				t.Errorf("actionable() set result %q, want %q", result, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestScanOrphansMinAgeFloor(t *testing.T) {
+	b := &broker{uidPrefix: "kube-rgw.", orphanMinAgeFloor: time.Hour}
+	tests := []struct {
+		name   string
+		action string
+		minAge time.Duration
+	}{
+		{name: "below the floor", action: ORPHAN_DELETE, minAge: time.Minute},
+		{name: "zero", action: ORPHAN_QUARANTINE, minAge: 0},
+		{name: "negative", action: ORPHAN_REPORT, minAge: -time.Hour},
+		{name: "invalid action", action: "purge", minAge: DEFAULT_ORPHAN_MIN_AGE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := b.ScanOrphans(tt.action, tt.minAge); err == nil {
+				t.Errorf("ScanOrphans(%q, %v) succeeded, want an error", tt.action, tt.minAge)
+			}
+		})
+	}
+}
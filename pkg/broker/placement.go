@@ -0,0 +1,91 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"strings"
+
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+const (
+	PLACEMENT     = "placement"
+	STORAGE_CLASS = "storageClass"
+)
+
+// rgwPlacement is a placement target and the default storage class within it.
+// Empty fields select the zonegroup (or placement) defaults.
+type rgwPlacement struct {
+	Placement    string
+	StorageClass string
+}
+
+// Parses a "<placement>[/<storage class>]" value.
+func parsePlacement(val string) rgwPlacement {
+	parts := strings.SplitN(val, "/", 2)
+	p := rgwPlacement{Placement: parts[0]}
+	if len(parts) > 1 {
+		p.StorageClass = parts[1]
+	}
+	return p
+}
+
+// Selects the placement of a new instance. The plan placement configured through
+// RGW_PLAN_PLACEMENTS is used unless the "placement" or "storageClass"
+// parameters override it. Plans that are defined by their placement, such as
+// "hot" and "cold", can't be overridden.
+func (b *broker) selectPlacement(plan *rgwPlan, req *brokerapi.CreateServiceInstanceRequest) (rgwPlacement, error) {
+	p, configured := b.planPlacements[plan.name]
+	if plan.needsPlacement && !configured {
+		return p, retErrInfof("Error: no placement configured for plan %q", plan.name)
+	}
+
+	for param, field := range map[string]*string{
+		PLACEMENT:     &p.Placement,
+		STORAGE_CLASS: &p.StorageClass,
+	} {
+		val, ok := req.Parameters[param]
+		if !ok {
+			continue
+		}
+		if plan.needsPlacement {
+			return p, retErrInfof("Error: parameter %q is not supported by plan %q", param, plan.name)
+		}
+		s, ok := val.(string)
+		if !ok || s == "" {
+			return p, retErrInfof("Error: parameter %q must be a non empty string", param)
+		}
+		*field = s
+	}
+	return p, nil
+}
+
+// Sets the default placement and storage class of the user, which apply to the
+// buckets it creates and to the objects written without a storage class.
+func (c *RGWClient) setUserPlacement(userName string, p rgwPlacement) error {
+	if p.Placement != "" {
+		if err := c.modifyUser(userName, "default-placement", p.Placement); err != nil {
+			return err
+		}
+	}
+	if p.StorageClass != "" {
+		if err := c.modifyUser(userName, "default-storage-class", p.StorageClass); err != nil {
+			return err
+		}
+	}
+	return nil
+}
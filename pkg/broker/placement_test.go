@@ -0,0 +1,73 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+func TestSelectPlacement(t *testing.T) {
+	b := &broker{
+		planPlacements: map[string]rgwPlacement{
+			"cold":    {Placement: "ec-placement", StorageClass: "COLD"},
+			"default": {Placement: "default-placement"},
+		},
+	}
+	defaultPlan := &rgwPlan{name: "default"}
+	cold := &rgwPlan{name: "cold", needsPlacement: true}
+	hot := &rgwPlan{name: "hot", needsPlacement: true}
+
+	tests := []struct {
+		name    string
+		plan    *rgwPlan
+		params  map[string]interface{}
+		want    rgwPlacement
+		wantErr bool
+	}{
+		{name: "plan placement", plan: defaultPlan, want: rgwPlacement{Placement: "default-placement"}},
+		{
+			name:   "overridden placement",
+			plan:   defaultPlan,
+			params: map[string]interface{}{PLACEMENT: "ssd-placement", STORAGE_CLASS: "FAST"},
+			want:   rgwPlacement{Placement: "ssd-placement", StorageClass: "FAST"},
+		},
+		{name: "empty storage class", plan: defaultPlan, params: map[string]interface{}{STORAGE_CLASS: ""}, wantErr: true},
+		{name: "fixed plan placement", plan: cold, want: rgwPlacement{Placement: "ec-placement", StorageClass: "COLD"}},
+		{name: "fixed placement overridden", plan: cold, params: map[string]interface{}{PLACEMENT: "ssd-placement"}, wantErr: true},
+		{name: "fixed storage class overridden", plan: cold, params: map[string]interface{}{STORAGE_CLASS: "STANDARD"}, wantErr: true},
+		{name: "plan placement not configured", plan: hot, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.selectPlacement(tt.plan, &brokerapi.CreateServiceInstanceRequest{Parameters: tt.params})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("selectPlacement() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectPlacement() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("selectPlacement() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
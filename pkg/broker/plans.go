@@ -0,0 +1,166 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+const (
+	SERVICE_ID = "3594c8a0-5aad-42b6-8809-dc367d1bbaed"
+
+	// the default plan predates the other plans and shares the service id
+	DEFAULT_PLAN_ID = "3594c8a0-5aad-42b6-8809-dc367d1bbaed"
+	SHARED_PLAN_ID  = "15b53da8-d6e9-4596-9f00-482f573be71f"
+	HOT_PLAN_ID     = "42b50a49-25ca-4d4c-8d7c-d128fca26844"
+	COLD_PLAN_ID    = "0417b401-cd4e-4296-8cf4-74822623039d"
+	WORM_PLAN_ID    = "34d3b823-e273-4345-8310-1c48ab8dd500"
+	SSE_S3_PLAN_ID  = "f39cc763-324e-4e89-993d-d096677d2382"
+	SSE_KMS_PLAN_ID = "879ade13-fb79-4420-9039-893375b7595d"
+	WEBSITE_PLAN_ID = "51f86cec-b1c0-4fa6-b3a7-a59f684f0a8d"
+)
+
+// rgwPlan describes a plan offered in the catalog, and how instances of it are
+// provisioned.
+type rgwPlan struct {
+	id          string
+	name        string
+	description string
+
+	// instances get a prefix inside the broker's shared bucket instead of
+	// a bucket of their own
+	sharedBucket bool
+
+	// the plan is only offered when a placement is configured for it in
+	// RGW_PLAN_PLACEMENTS
+	needsPlacement bool
+
+	// lifecycle rules of the instance buckets, unless the "lifecycle"
+	// parameter is given
+	lifecycle []lifecycleRule
+
+	// buckets are created with Object Lock enabled, with this default
+	// retention unless the "retention" parameter is given
+	objectLock bool
+	retention  *objectRetention
+
+	// default encryption of the buckets, SSE_S3 or SSE_KMS. SSE_KMS plans
+	// are only offered when a kms is configured through RGW_KMS_BACKEND.
+	encryption string
+
+	// the bucket is served as a public static website. The plan is only
+	// offered when its backend has a website endpoint configured.
+	website bool
+}
+
+// removes the leftovers of abandoned multipart uploads. The default plan
+// doesn't set it, so its buckets keep the behaviour they always had; it can be
+// asked for through the "lifecycle" parameter.
+var abortMultipartRule = lifecycleRule{
+	ID:                           "abort-incomplete-multipart",
+	AbortIncompleteMultipartDays: 7,
+}
+
+var rgwPlans = []rgwPlan{
+	{
+		id:          DEFAULT_PLAN_ID,
+		name:        "default",
+		description: "A dedicated bucket owned by a new RGW user.",
+	},
+	{
+		id:           SHARED_PLAN_ID,
+		name:         "shared",
+		description:  "A prefix inside a shared bucket, for small and short lived workloads.",
+		sharedBucket: true,
+	},
+	{
+		id:             HOT_PLAN_ID,
+		name:           "hot",
+		description:    "A dedicated bucket on the placement configured for frequently accessed data.",
+		needsPlacement: true,
+		lifecycle:      []lifecycleRule{abortMultipartRule},
+	},
+	{
+		id:             COLD_PLAN_ID,
+		name:           "cold",
+		description:    "A dedicated bucket on the placement configured for archival data.",
+		needsPlacement: true,
+		lifecycle:      []lifecycleRule{abortMultipartRule},
+	},
+	{
+		id:          WORM_PLAN_ID,
+		name:        "compliance",
+		description: "A dedicated write once read many bucket, objects can't be overwritten or deleted while under retention.",
+		lifecycle:   []lifecycleRule{abortMultipartRule},
+		objectLock:  true,
+		retention:   &objectRetention{Mode: "COMPLIANCE", Years: 1},
+	},
+	{
+		id:          SSE_S3_PLAN_ID,
+		name:        "encrypted",
+		description: "A dedicated bucket with objects encrypted at rest by RGW managed keys (SSE-S3).",
+		lifecycle:   []lifecycleRule{abortMultipartRule},
+		encryption:  SSE_S3,
+	},
+	{
+		id:          SSE_KMS_PLAN_ID,
+		name:        "encrypted-kms",
+		description: "A dedicated bucket with objects encrypted at rest by a per instance KMS key (SSE-KMS).",
+		lifecycle:   []lifecycleRule{abortMultipartRule},
+		encryption:  SSE_KMS,
+	},
+	{
+		id:          WEBSITE_PLAN_ID,
+		name:        "website",
+		description: "A dedicated bucket served as a public static website, objects are readable by anyone.",
+		lifecycle:   []lifecycleRule{abortMultipartRule},
+		website:     true,
+	},
+}
+
+// Returns the plan with the given id. An empty id selects the default plan, so
+// that requests from older clients keep working.
+func findPlan(planID string) (*rgwPlan, error) {
+	if planID == "" {
+		planID = DEFAULT_PLAN_ID
+	}
+	for i := range rgwPlans {
+		if rgwPlans[i].id == planID {
+			return &rgwPlans[i], nil
+		}
+	}
+	return nil, retErrInfof("Plan %q not found.", planID)
+}
+
+// Returns the plan with the given name.
+func findPlanByName(name string) (*rgwPlan, error) {
+	for i := range rgwPlans {
+		if rgwPlans[i].name == name {
+			return &rgwPlans[i], nil
+		}
+	}
+	return nil, retErrInfof("Plan %q not found.", name)
+}
+
+func (p *rgwPlan) servicePlan() brokerapi.ServicePlan {
+	return brokerapi.ServicePlan{
+		Name:        p.name,
+		ID:          p.id,
+		Description: p.description,
+		Free:        true,
+	}
+}
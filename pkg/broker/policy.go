@@ -0,0 +1,343 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+)
+
+const (
+	QUOTA_GB = "quotaGB"
+
+	gigabyte = int64(1) << 30
+)
+
+// namespaceLimits is what a namespace may provision. Zero limits are not
+// enforced.
+type namespaceLimits struct {
+	// plan names the namespace may use, empty for all of them
+	Plans        []string `json:"plans,omitempty"`
+	MaxInstances int      `json:"maxInstances,omitempty"`
+	MaxBindings  int      `json:"maxBindings,omitempty"`
+	// cap on the sum of the quotas the broker set on the instances of the
+	// namespace. It is advisory, quotas changed directly in RGW are not seen.
+	MaxStorageGB int64 `json:"maxStorageGB,omitempty"`
+	// quota of the instances that don't request one through "quotaGB"
+	DefaultQuotaGB int64 `json:"defaultQuotaGB,omitempty"`
+}
+
+// namespacePolicy is loaded from the file named by RGW_NAMESPACE_POLICY, e.g.
+//
+//	default:
+//	  plans: ["default", "shared"]
+//	  maxInstances: 5
+//	namespaces:
+//	  analytics:
+//	    maxInstances: 20
+//	    maxStorageGB: 1000
+//	    defaultQuotaGB: 100
+//
+// Namespaces that are not listed get the default limits, or are denied if
+// there are none.
+type namespacePolicy struct {
+	Default    *namespaceLimits           `json:"default,omitempty"`
+	Namespaces map[string]namespaceLimits `json:"namespaces,omitempty"`
+}
+
+func loadNamespacePolicy(path string) (*namespacePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespace policy: %v", err)
+	}
+	p := &namespacePolicy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse namespace policy %s: %v", path, err)
+	}
+	limits := []namespaceLimits{}
+	if p.Default != nil {
+		limits = append(limits, *p.Default)
+	}
+	for _, l := range p.Namespaces {
+		limits = append(limits, l)
+	}
+	for _, l := range limits {
+		for _, name := range l.Plans {
+			if _, err := findPlanByName(name); err != nil {
+				return nil, fmt.Errorf("namespace policy %s: unknown plan %q", path, name)
+			}
+		}
+		if l.MaxInstances < 0 || l.MaxBindings < 0 || l.MaxStorageGB < 0 || l.DefaultQuotaGB < 0 {
+			return nil, fmt.Errorf("namespace policy %s: limits must not be negative", path)
+		}
+	}
+	return p, nil
+}
+
+// Returns the limits of the namespace, or nil if it may not provision
+// anything.
+func (p *namespacePolicy) limits(namespace string) *namespaceLimits {
+	if l, ok := p.Namespaces[namespace]; ok {
+		return &l
+	}
+	return p.Default
+}
+
+// Returns the error denying a request that breaks the namespace policy, naming
+// who asked. The identity is only reported, the policy applies to the
+// namespace whoever asks.
+func policyDenied(identity *OriginatingIdentity, format string, args ...interface{}) error {
+	return retErrInfof("%s, requested by %s", fmt.Sprintf(format, args...), identity)
+}
+
+func (l *namespaceLimits) allowsPlan(plan *rgwPlan) bool {
+	if len(l.Plans) == 0 {
+		return true
+	}
+	for _, name := range l.Plans {
+		if name == plan.name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the quota requested through the "quotaGB" parameter, 0 if none.
+func getQuotaParam(params map[string]interface{}) (int64, error) {
+	val, ok := params[QUOTA_GB]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := val.(float64)
+	if !ok || n < 1 || n != float64(int64(n)) {
+		return 0, retErrInfof("Error: parameter %q must be a positive integer", QUOTA_GB)
+	}
+	return int64(n) * gigabyte, nil
+}
+
+// Checks the creation of an instance against the namespace policy, and returns
+// the quota of the new instance in bytes, 0 for none.
+func (b *broker) checkCreatePolicy(namespace string, plan *rgwPlan, params map[string]interface{}, identity *OriginatingIdentity) (int64, error) {
+	quota, err := getQuotaParam(params)
+	if err != nil {
+		return 0, err
+	}
+	if b.policy == nil {
+		return quota, nil
+	}
+
+	limits := b.policy.limits(namespace)
+	if limits == nil {
+		return 0, policyDenied(identity, "Error: namespace %q is not allowed to provision instances", namespace)
+	}
+	if !limits.allowsPlan(plan) {
+		return 0, policyDenied(identity, "Error: namespace %q is not allowed to use plan %q", namespace, plan.name)
+	}
+	if quota == 0 {
+		quota = limits.DefaultQuotaGB * gigabyte
+	}
+	if limits.MaxInstances == 0 && limits.MaxStorageGB == 0 {
+		return quota, nil
+	}
+
+	usage, err := b.getNamespaceUsage(namespace)
+	if err != nil {
+		return 0, err
+	}
+	count := usage.Instances
+	storage := usage.QuotaBytes
+
+	if limits.MaxInstances > 0 && count >= limits.MaxInstances {
+		return 0, policyDenied(identity, "Error: namespace %q reached its limit of %d instances", namespace, limits.MaxInstances)
+	}
+	if limits.MaxStorageGB > 0 {
+		if plan.sharedBucket {
+			return 0, policyDenied(identity, "Error: plan %q can't be used by namespace %q, which has a storage cap", plan.name, namespace)
+		}
+		if quota == 0 {
+			return 0, policyDenied(identity, "Error: namespace %q has a storage cap, parameter %q is required", namespace, QUOTA_GB)
+		}
+		if storage+quota > limits.MaxStorageGB*gigabyte {
+			return 0, policyDenied(identity, "Error: namespace %q would exceed its storage cap of %d GB, %d GB are already allocated",
+				namespace, limits.MaxStorageGB, storage/gigabyte)
+		}
+	}
+	return quota, nil
+}
+
+// Checks the creation of a binding against the namespace policy.
+func (b *broker) checkBindPolicy(namespace string, identity *OriginatingIdentity) error {
+	if b.policy == nil {
+		return nil
+	}
+	limits := b.policy.limits(namespace)
+	if limits == nil {
+		return policyDenied(identity, "Error: namespace %q is not allowed to provision instances", namespace)
+	}
+	if limits.MaxBindings == 0 {
+		return nil
+	}
+
+	usage, err := b.getNamespaceUsage(namespace)
+	if err != nil {
+		return err
+	}
+	if usage.Bindings >= limits.MaxBindings {
+		return policyDenied(identity, "Error: namespace %q reached its limit of %d bindings", namespace, limits.MaxBindings)
+	}
+	return nil
+}
+
+// namespaceUsage counts what a namespace has provisioned, so that its limits
+// are checked without reading every record. It is kept in the data bucket and
+// only changed under the namespace lock, whether or not a policy is
+// configured, so that it is right once one is.
+type namespaceUsage struct {
+	Instances int
+	// bindings of the instances of the namespace
+	Bindings   int
+	QuotaBytes int64
+}
+
+func getNamespaceOid(namespace string) string {
+	return "namespace/" + namespace
+}
+
+// Returns the usage record of the namespace. A missing record is rebuilt from
+// the instance and binding records, and stored.
+func (b *broker) getNamespaceUsage(namespace string) (*namespaceUsage, error) {
+	usage, err := b.readNamespaceUsage(namespace)
+	if err != nil || usage != nil {
+		return usage, err
+	}
+	return b.rebuildNamespaceUsage(namespace)
+}
+
+// Reads the usage record of the namespace, nil if there is none.
+func (b *broker) readNamespaceUsage(namespace string) (*namespaceUsage, error) {
+	oid := getNamespaceOid(namespace)
+	_, err := b.rgw.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &b.dataBucket,
+		Key:    &oid,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the usage record of namespace %q: %v", namespace, err)
+	}
+
+	usage := new(namespaceUsage)
+	if err := b.readInfo(oid, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (b *broker) rebuildNamespaceUsage(namespace string) (*namespaceUsage, error) {
+	glog.Infof("Counting the instances and bindings of namespace %q", namespace)
+	instances, err := b.listInstances()
+	if err != nil {
+		return nil, err
+	}
+	usage := &namespaceUsage{}
+	for id, instance := range instances {
+		if instance.Namespace != namespace {
+			continue
+		}
+		n, err := b.countBindings(id)
+		if err != nil {
+			return nil, err
+		}
+		usage.Instances++
+		usage.Bindings += n
+		usage.QuotaBytes += instance.QuotaBytes
+	}
+	if err := b.storeInfo(getNamespaceOid(namespace), usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Adds the change to the usage record of the namespace, once the records it
+// counts were changed. A missing record is rebuilt from them instead, which
+// already include the change. On failure the record is removed, to be rebuilt
+// by the next check.
+func (b *broker) updateNamespaceUsage(namespace string, change namespaceUsage) {
+	usage, err := b.readNamespaceUsage(namespace)
+	if err == nil && usage == nil {
+		_, err = b.rebuildNamespaceUsage(namespace)
+	} else if err == nil {
+		usage.Instances += change.Instances
+		usage.Bindings += change.Bindings
+		usage.QuotaBytes += change.QuotaBytes
+		err = b.storeInfo(getNamespaceOid(namespace), usage)
+	}
+	if err != nil {
+		glog.Errorf("Warning: failed to update the usage record of namespace %q: %v", namespace, err)
+		b.resetNamespaceUsage(namespace)
+	}
+}
+
+// Removes the usage record of the namespace, for when it can't be kept right.
+func (b *broker) resetNamespaceUsage(namespace string) {
+	if err := b.removeInfo(getNamespaceOid(namespace)); err != nil {
+		glog.Errorf("Warning: failed to remove the usage record of namespace %q, its limits may be off: %v", namespace, err)
+	}
+}
+
+// Returns the number of binding records of the instance.
+func (b *broker) countBindings(instanceID string) (int, error) {
+	prefix := getBindOid(instanceID, "")
+	count := 0
+	err := b.rgw.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &b.dataBucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		count += len(page.Contents)
+		return true
+	})
+	if err != nil {
+		return 0, retErrInfof("Error listing bindings of instance %s: %v", instanceID, err)
+	}
+	return count, nil
+}
+
+// Sets the quota of the user, which applies to all the buckets it owns.
+func (rgw *RGWClient) setUserQuota(userName string, bytes int64) error {
+	glog.Infof("Setting quota of user %q to %d bytes", userName, bytes)
+
+	params := make(url.Values)
+	params.Set("uid", userName)
+	params.Set("quota-type", "user")
+	params.Set("max-size-kb", strconv.FormatInt(bytes/1024, 10))
+	params.Set("max-objects", "-1")
+	params.Set("enabled", "true")
+
+	_, err := rgw.rgwAdminRequest("PUT", "user", "quota", params, nil)
+	if err != nil {
+		return retErrInfof("Error setting quota of user %s: %v", userName, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUpdateNamespaceUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		change namespaceUsage
+		want   namespaceUsage
+	}{
+		{name: "new instance", change: namespaceUsage{Instances: 1, QuotaBytes: 10 * gigabyte}, want: namespaceUsage{Instances: 3, Bindings: 4, QuotaBytes: 30 * gigabyte}},
+		{name: "new binding", change: namespaceUsage{Bindings: 1}, want: namespaceUsage{Instances: 2, Bindings: 5, QuotaBytes: 20 * gigabyte}},
+		{
+			name:   "removed instance",
+			change: namespaceUsage{Instances: -1, Bindings: -3, QuotaBytes: -10 * gigabyte},
+			want:   namespaceUsage{Instances: 1, Bindings: 1, QuotaBytes: 10 * gigabyte},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, b, stop := newFakeDataBucket(t, map[string]interface{}{
+				getNamespaceOid("team-a"): namespaceUsage{Instances: 2, Bindings: 4, QuotaBytes: 20 * gigabyte},
+				getNamespaceOid("team-b"): namespaceUsage{Instances: 7},
+			})
+			defer stop()
+
+			b.updateNamespaceUsage("team-a", tt.change)
+
+			var got namespaceUsage
+			if !d.get(t, getNamespaceOid("team-a"), &got) {
+				t.Fatalf("usage record of the namespace removed")
+			}
+			if got != tt.want {
+				t.Errorf("usage = %+v, want %+v", got, tt.want)
+			}
+			var other namespaceUsage
+			if !d.get(t, getNamespaceOid("team-b"), &other) || other != (namespaceUsage{Instances: 7}) {
+				t.Errorf("usage of another namespace changed to %+v", other)
+			}
+		})
+	}
+}
+
+func TestCheckBindPolicy(t *testing.T) {
+	_, b, stop := newFakeDataBucket(t, map[string]interface{}{
+		getNamespaceOid("team-a"): namespaceUsage{Instances: 2, Bindings: 4},
+		getNamespaceOid("team-b"): namespaceUsage{Instances: 2, Bindings: 5},
+	})
+	defer stop()
+	b.policy = &namespacePolicy{Default: &namespaceLimits{MaxBindings: 5}}
+
+	if err := b.checkBindPolicy("team-a", nil); err != nil {
+		t.Errorf("checkBindPolicy() = %v for a namespace below its limit", err)
+	}
+	if err := b.checkBindPolicy("team-b", nil); err == nil {
+		t.Errorf("checkBindPolicy() succeeded for a namespace at its limit")
+	}
+
+	// the identity is reported, and never lifts a limit
+	admin := &OriginatingIdentity{Platform: KUBERNETES_PLATFORM, Username: "admin", Groups: []string{"system:masters"}}
+	err := b.checkBindPolicy("team-b", admin)
+	if err == nil {
+		t.Fatalf("checkBindPolicy() succeeded for a namespace at its limit, asked by %s", admin)
+	}
+	if !strings.Contains(err.Error(), "kubernetes:admin") {
+		t.Errorf("checkBindPolicy() = %q, want the identity in the message", err)
+	}
+}
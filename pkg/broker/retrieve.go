@@ -0,0 +1,67 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+// GetServiceInstanceResponse is the instance returned by the instance GET of
+// the Open Service Broker API 2.14.
+type GetServiceInstanceResponse struct {
+	ServiceID    string `json:"service_id"`
+	PlanID       string `json:"plan_id"`
+	DashboardURL string `json:"dashboard_url,omitempty"`
+}
+
+// GetServiceBindingResponse is the binding returned by the binding GET of the
+// Open Service Broker API 2.14.
+type GetServiceBindingResponse struct {
+	Credentials brokerapi.Credential `json:"credentials"`
+}
+
+// Implements the `GetServiceInstance` interface method.
+func (b *broker) GetServiceInstance(instanceID string) (*GetServiceInstanceResponse, error) {
+	glog.Infof("GetServiceInstance called. instanceID: %s", instanceID)
+	instance, err := b.findInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	planID := instance.PlanID
+	if planID == "" {
+		planID = DEFAULT_PLAN_ID
+	}
+	return &GetServiceInstanceResponse{
+		ServiceID:    SERVICE_ID,
+		PlanID:       planID,
+		DashboardURL: b.dashboardURL(instanceID),
+	}, nil
+}
+
+// Implements the `GetServiceBinding` interface method.
+func (b *broker) GetServiceBinding(instanceID, bindingID string) (*GetServiceBindingResponse, error) {
+	glog.Infof("GetServiceBinding called. instanceID: %q, bindingID: %q", instanceID, bindingID)
+	if _, err := b.findInstance(instanceID); err != nil {
+		return nil, err
+	}
+	info, err := b.getBindInfo(instanceID, bindingID)
+	if err != nil {
+		return nil, retErrInfof("Binding %q of instance %q not found.", bindingID, instanceID)
+	}
+	return &GetServiceBindingResponse{Credentials: info.Credential}, nil
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+// The JSON schemas of the plan parameters, published in the catalog and used
+// to validate the parameters of incoming requests. Only the subset of JSON
+// schema used here is supported by validateSchema: type, enum, properties,
+// required, additionalProperties, items, minItems, minLength, maxLength and
+// minimum.
+type jsonSchema map[string]interface{}
+
+func objectSchema(props map[string]jsonSchema, required ...string) jsonSchema {
+	s := jsonSchema{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func arraySchema(items jsonSchema) jsonSchema {
+	return jsonSchema{"type": "array", "items": items}
+}
+
+func stringSchema(minLength int) jsonSchema {
+	return jsonSchema{"type": "string", "minLength": minLength}
+}
+
+func enumSchema(values ...string) jsonSchema {
+	enum := make([]interface{}, len(values))
+	for i, v := range values {
+		enum[i] = v
+	}
+	return jsonSchema{"type": "string", "enum": enum}
+}
+
+func integerSchema(minimum int) jsonSchema {
+	return jsonSchema{"type": "integer", "minimum": minimum}
+}
+
+var lifecycleSchema = arraySchema(objectSchema(map[string]jsonSchema{
+	"id":                              stringSchema(1),
+	"prefix":                          {"type": "string"},
+	"expirationDays":                  integerSchema(1),
+	"noncurrentVersionExpirationDays": integerSchema(1),
+	"abortIncompleteMultipartDays":    integerSchema(1),
+	"transitions": arraySchema(objectSchema(map[string]jsonSchema{
+		"days":         integerSchema(0),
+		"storageClass": stringSchema(1),
+	}, "days", "storageClass")),
+}))
+
+var corsSchema = arraySchema(objectSchema(map[string]jsonSchema{
+	"allowedOrigins": arraySchema(stringSchema(1)),
+	"allowedMethods": arraySchema(enumSchema("GET", "PUT", "POST", "DELETE", "HEAD")),
+	"allowedHeaders": arraySchema(stringSchema(1)),
+	"exposeHeaders":  arraySchema(stringSchema(1)),
+	"maxAgeSeconds":  integerSchema(0),
+}, "allowedOrigins", "allowedMethods"))
+
+var retentionSchema = objectSchema(map[string]jsonSchema{
+	"mode":  enumSchema("COMPLIANCE"),
+	"days":  integerSchema(1),
+	"years": integerSchema(1),
+}, "mode")
+
+var notificationsSchema = objectSchema(map[string]jsonSchema{
+	"endpoint":   stringSchema(1),
+	"events":     arraySchema(stringSchema(1)),
+	"prefix":     stringSchema(1),
+	"suffix":     stringSchema(1),
+	"attributes": notificationAttributesSchema(),
+}, "endpoint")
+
+func notificationAttributesSchema() jsonSchema {
+	props := make(map[string]jsonSchema)
+	for _, key := range notificationAttributes {
+		props[key] = jsonSchema{"type": "string"}
+	}
+	return objectSchema(props)
+}
+
+// Returns the schema of the bucket settings, which can be given both when the
+// instance is created and when it is updated.
+func settingsSchema(plan *rgwPlan) map[string]jsonSchema {
+	props := map[string]jsonSchema{
+		VERSIONING: enumSchema(VERSIONING_ENABLED, VERSIONING_SUSPENDED),
+		LIFECYCLE:  lifecycleSchema,
+		CORS:       corsSchema,
+	}
+	if plan.objectLock {
+		props[VERSIONING] = enumSchema(VERSIONING_ENABLED)
+		props[RETENTION] = retentionSchema
+	}
+	return props
+}
+
+// Returns the schema of the parameters accepted when creating an instance.
+func (b *broker) createSchema(plan *rgwPlan) jsonSchema {
+	props := map[string]jsonSchema{
+		BACKEND: enumSchema(b.backendNames()...),
+	}
+	if plan.sharedBucket {
+		return objectSchema(props)
+	}
+
+	for name, s := range settingsSchema(plan) {
+		props[name] = s
+	}
+	props[BUCKET_NAME] = stringSchema(1)
+	if !plan.needsPlacement {
+		props[PLACEMENT] = stringSchema(1)
+		props[STORAGE_CLASS] = stringSchema(1)
+	}
+	if len(b.notificationHosts) > 0 {
+		props[NOTIFICATIONS] = notificationsSchema
+	}
+	props[QUOTA_GB] = integerSchema(1)
+	if !plan.website {
+		props[BUCKETS] = jsonSchema{"type": "array", "items": stringSchema(1), "minItems": 1}
+	}
+	if !plan.objectLock && plan.encryption == "" && !plan.website {
+		props[ADOPT_BUCKET] = stringSchema(3)
+	}
+	if plan.website {
+		props[INDEX_DOCUMENT] = stringSchema(1)
+		props[ERROR_DOCUMENT] = stringSchema(1)
+	}
+	return objectSchema(props)
+}
+
+// Returns the schema of the parameters accepted when updating an instance. The
+// platform may send all the parameters of the instance again, so this is the
+// create schema; only the bucket settings may change, which the update checks
+// against the values the instance was created with.
+func (b *broker) updateSchema(plan *rgwPlan) jsonSchema {
+	return b.createSchema(plan)
+}
+
+// Bindings take no parameters.
+func (b *broker) bindSchema(plan *rgwPlan) jsonSchema {
+	return objectSchema(map[string]jsonSchema{})
+}
+
+func (b *broker) planSchemas(plan *rgwPlan) *brokerapi.Schemas {
+	return &brokerapi.Schemas{
+		ServiceInstances: &brokerapi.ServiceInstanceSchema{
+			Create: &brokerapi.InputParameters{Parameters: b.createSchema(plan)},
+			Update: &brokerapi.InputParameters{Parameters: b.updateSchema(plan)},
+		},
+		ServiceBindings: &brokerapi.ServiceBindingSchema{
+			Create: &brokerapi.InputParameters{Parameters: b.bindSchema(plan)},
+		},
+	}
+}
+
+func (b *broker) backendNames() []string {
+	names := make([]string, 0, len(b.backends))
+	for name := range b.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validates the request parameters against the schema, returning an error
+// that names the offending parameter.
+func validateParams(schema jsonSchema, params map[string]interface{}) error {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	if err := validateSchema(schema, "", params); err != nil {
+		return retErrInfof("Error: %v", err)
+	}
+	return nil
+}
+
+func validateSchema(schema jsonSchema, path string, val interface{}) error {
+	name := path
+	if name == "" {
+		name = "parameters"
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("parameter %q must be an object", name)
+		}
+		return validateObject(schema, path, obj)
+	case "array":
+		list, ok := val.([]interface{})
+		if !ok {
+			return fmt.Errorf("parameter %q must be a list", name)
+		}
+		if min, ok := schema["minItems"].(int); ok && len(list) < min {
+			return fmt.Errorf("parameter %q must have at least %d items", name, min)
+		}
+		if items, ok := schema["items"].(jsonSchema); ok {
+			for i, item := range list {
+				if err := validateSchema(items, fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("parameter %q must be a string", name)
+		}
+		if min, ok := schema["minLength"].(int); ok && len(s) < min {
+			return fmt.Errorf("parameter %q must be at least %d characters long", name, min)
+		}
+		if max, ok := schema["maxLength"].(int); ok && len(s) > max {
+			return fmt.Errorf("parameter %q must be at most %d characters long", name, max)
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			for _, e := range enum {
+				if e == s {
+					return nil
+				}
+			}
+			return fmt.Errorf("parameter %q must be one of %v", name, enum)
+		}
+	case "integer":
+		n, ok := val.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("parameter %q must be an integer", name)
+		}
+		if min, ok := schema["minimum"].(int); ok && n < float64(min) {
+			return fmt.Errorf("parameter %q must be at least %d", name, min)
+		}
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("parameter %q must be a boolean", name)
+		}
+	}
+	return nil
+}
+
+func validateObject(schema jsonSchema, path string, obj map[string]interface{}) error {
+	props, _ := schema["properties"].(map[string]jsonSchema)
+
+	if required, ok := schema["required"].([]string); ok {
+		for _, key := range required {
+			if _, ok := obj[key]; !ok {
+				return fmt.Errorf("parameter %q is required", joinPath(path, key))
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		prop, ok := props[key]
+		if !ok {
+			if schema["additionalProperties"] == false {
+				return fmt.Errorf("unknown parameter %q", joinPath(path, key))
+			}
+			continue
+		}
+		if err := validateSchema(prop, joinPath(path, key), obj[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return strings.Join([]string{path, key}, ".")
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	schema := jsonSchema{
+		"type":                 "object",
+		"additionalProperties": false,
+		"required":             []string{"name"},
+		"properties": map[string]jsonSchema{
+			"name": {"type": "string", "minLength": 3, "maxLength": 8},
+			"mode": {"type": "string", "enum": []interface{}{"on", "off"}},
+			"size": {"type": "integer", "minimum": 1},
+			"flag": {"type": "boolean"},
+			"tags": {
+				"type":     "array",
+				"minItems": 1,
+				"items":    jsonSchema{"type": "string"},
+			},
+			"nested": {
+				"type": "object",
+				"properties": map[string]jsonSchema{
+					"days": {"type": "integer"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		val     interface{}
+		wantErr string
+	}{
+		{
+			name: "valid",
+			val: map[string]interface{}{
+				"name":   "bucket",
+				"mode":   "on",
+				"size":   float64(2),
+				"flag":   true,
+				"tags":   []interface{}{"a"},
+				"nested": map[string]interface{}{"days": float64(7), "other": "kept"},
+			},
+		},
+		{
+			name:    "not an object",
+			val:     "bucket",
+			wantErr: `parameter "parameters" must be an object`,
+		},
+		{
+			name:    "missing required",
+			val:     map[string]interface{}{},
+			wantErr: `parameter "name" is required`,
+		},
+		{
+			name:    "unknown parameter",
+			val:     map[string]interface{}{"name": "bucket", "color": "red"},
+			wantErr: `unknown parameter "color"`,
+		},
+		{
+			name:    "string too short",
+			val:     map[string]interface{}{"name": "ab"},
+			wantErr: `parameter "name" must be at least 3 characters long`,
+		},
+		{
+			name:    "string too long",
+			val:     map[string]interface{}{"name": "abcdefghi"},
+			wantErr: `parameter "name" must be at most 8 characters long`,
+		},
+		{
+			name:    "not in enum",
+			val:     map[string]interface{}{"name": "bucket", "mode": "auto"},
+			wantErr: `parameter "mode" must be one of [on off]`,
+		},
+		{
+			name:    "fractional integer",
+			val:     map[string]interface{}{"name": "bucket", "size": 1.5},
+			wantErr: `parameter "size" must be an integer`,
+		},
+		{
+			name:    "integer below minimum",
+			val:     map[string]interface{}{"name": "bucket", "size": float64(0)},
+			wantErr: `parameter "size" must be at least 1`,
+		},
+		{
+			name:    "not a boolean",
+			val:     map[string]interface{}{"name": "bucket", "flag": "true"},
+			wantErr: `parameter "flag" must be a boolean`,
+		},
+		{
+			name:    "empty list",
+			val:     map[string]interface{}{"name": "bucket", "tags": []interface{}{}},
+			wantErr: `parameter "tags" must have at least 1 items`,
+		},
+		{
+			name:    "invalid list item",
+			val:     map[string]interface{}{"name": "bucket", "tags": []interface{}{"a", float64(1)}},
+			wantErr: `parameter "tags[1]" must be a string`,
+		},
+		{
+			name:    "invalid nested parameter",
+			val:     map[string]interface{}{"name": "bucket", "nested": map[string]interface{}{"days": "7"}},
+			wantErr: `parameter "nested.days" must be an integer`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSchema(schema, "", tt.val)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateSchema() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validateSchema() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
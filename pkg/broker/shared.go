@@ -0,0 +1,329 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+	"github.com/rs/xid"
+)
+
+const (
+	PREFIX = "prefix"
+
+	// what happens to the objects under a prefix when its instance is removed
+	SHARED_PREFIX_ARCHIVE = "archive"
+	SHARED_PREFIX_DELETE  = "delete"
+)
+
+type bucketPolicy struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string                            `json:"Sid,omitempty"`
+	Effect    string                            `json:"Effect"`
+	Principal interface{}                       `json:"Principal"`
+	Action    []string                          `json:"Action"`
+	Resource  []string                          `json:"Resource"`
+	Condition map[string]map[string]interface{} `json:"Condition,omitempty"`
+}
+
+// Provisions an instance of a shared bucket plan. The instance gets its own
+// user, but instead of a bucket it is granted access to a prefix inside the
+// broker's shared bucket through the bucket policy.
+func (b *broker) createSharedInstance(rgw *RGWClient, instanceID string, plan *rgwPlan, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error) {
+	for _, param := range []string{BUCKET_NAME, BUCKETS, ADOPT_BUCKET, PLACEMENT, STORAGE_CLASS, VERSIONING, LIFECYCLE, CORS, RETENTION, NOTIFICATIONS, INDEX_DOCUMENT, ERROR_DOCUMENT, QUOTA_GB} {
+		if _, ok := req.Parameters[param]; ok {
+			return nil, retErrInfof("Error: parameter %q is not supported by plan %q", param, plan.name)
+		}
+	}
+
+	prefix := instanceID + "/"
+	if req.ContextProfile.Namespace != "" {
+		prefix = req.ContextProfile.Namespace + "/" + prefix
+	}
+	glog.Infof("Creating new prefix: %s/%s for instance %q.", b.sharedBucket, prefix, instanceID)
+
+	if err := rgw.createBucket(b.sharedBucket, bucketOptions{}); err != nil {
+		return nil, err
+	}
+
+	userName := b.uidPrefix + xid.New().String()
+	unlockUser, err := b.lock(userLockKey(userName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlockUser()
+
+	_, err = rgw.provisionUser(userName, "rgw-broker-instance-"+instanceID, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// a failure past this point must not leave the user or its access to
+	// the prefix behind
+	provisioned := false
+	defer func() {
+		if provisioned {
+			return
+		}
+		glog.Infof("Rolling back the provision of user %s", userName)
+		if err := b.revokePrefixAccess(rgw, instanceID, b.sharedBucket); err != nil {
+			glog.Errorf("Warning: failed to revoke the prefix access of instance %s: %v", instanceID, err)
+		}
+		if err := rgw.removeUser(userName); err != nil {
+			glog.Errorf("Warning: failed to remove user %s: %v", userName, err)
+		}
+	}()
+
+	if err := rgw.modifyUser(userName, "max-buckets", "-1"); err != nil {
+		return nil, err
+	}
+
+	if err := b.grantPrefixAccess(rgw, instanceID, userName, prefix); err != nil {
+		return nil, err
+	}
+
+	instanceInfo := rgwServiceInstance{
+		Namespace:        req.ContextProfile.Namespace,
+		Endpoint:         rgw.endpoint,
+		UserName:         userName,
+		BucketName:       b.sharedBucket,
+		PlanID:           plan.id,
+		Backend:          rgw.backend,
+		Prefix:           prefix,
+		CreateParameters: createOnlyValues(req.Parameters),
+		CreatedBy:        identity,
+		LastModifiedBy:   identity,
+	}
+
+	err = b.storeInstanceInfo(instanceID, instanceInfo)
+	if err != nil {
+		return nil, retErrInfof("Error: failed to store instance info: %s", err)
+	}
+	provisioned = true
+	b.updateNamespaceUsage(instanceInfo.Namespace, namespaceUsage{Instances: 1})
+
+	b.cacheInstance(instanceID, &instanceInfo)
+
+	return &brokerapi.CreateServiceInstanceResponse{
+		DashboardURL: b.dashboardURL(instanceID),
+	}, nil
+}
+
+// Removes an instance of a shared bucket plan. The access to the prefix is
+// revoked, and its objects are either deleted or left in place depending on
+// the configured gc mode.
+func (b *broker) removeSharedInstance(instanceID string, instance *rgwServiceInstance) error {
+	rgw, err := b.instanceBackend(instance)
+	if err != nil {
+		return err
+	}
+
+	err = rgw.suspendUser(instance.UserName)
+	if err != nil {
+		return fmt.Errorf("Error failed to suspend user: %v", err)
+	}
+
+	if err := b.revokePrefixAccess(rgw, instanceID, instance.BucketName); err != nil {
+		return err
+	}
+
+	if b.sharedPrefixGC == SHARED_PREFIX_DELETE {
+		if err := rgw.deletePrefix(instance.BucketName, instance.Prefix); err != nil {
+			return err
+		}
+	} else {
+		glog.Infof("Archiving prefix %s/%s", instance.BucketName, instance.Prefix)
+	}
+
+	err = rgw.removeUser(instance.UserName)
+	if err != nil {
+		return fmt.Errorf("Error failed to remove user %s: %v", instance.UserName, err)
+	}
+	return nil
+}
+
+// Returns the statement id prefix used for the policy statements of an instance.
+func policySid(instanceID string) string {
+	return "instance" + strings.Replace(instanceID, "-", "", -1)
+}
+
+func (b *broker) grantPrefixAccess(rgw *RGWClient, instanceID, userName, prefix string) error {
+	unlock, err := b.lock(SHARED_BUCKET_LOCK)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	policy, err := rgw.getBucketPolicy(b.sharedBucket)
+	if err != nil {
+		return err
+	}
+
+	sid := policySid(instanceID)
+	principal := map[string][]string{"AWS": {"arn:aws:iam:::user/" + userName}}
+
+	policy.Statement = append(policy.Statement,
+		policyStatement{
+			Sid:       sid + "List",
+			Effect:    "Allow",
+			Principal: principal,
+			Action:    []string{"s3:ListBucket"},
+			Resource:  []string{"arn:aws:s3:::" + b.sharedBucket},
+			Condition: map[string]map[string]interface{}{
+				"StringLike": {"s3:prefix": []string{prefix + "*"}},
+			},
+		},
+		policyStatement{
+			Sid:       sid + "Objects",
+			Effect:    "Allow",
+			Principal: principal,
+			Action: []string{
+				"s3:GetObject",
+				"s3:PutObject",
+				"s3:DeleteObject",
+				"s3:AbortMultipartUpload",
+				"s3:ListMultipartUploadParts",
+			},
+			Resource: []string{"arn:aws:s3:::" + b.sharedBucket + "/" + prefix + "*"},
+		})
+
+	return rgw.putBucketPolicy(b.sharedBucket, policy)
+}
+
+func (b *broker) revokePrefixAccess(rgw *RGWClient, instanceID, bucketName string) error {
+	unlock, err := b.lock(SHARED_BUCKET_LOCK)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	policy, err := rgw.getBucketPolicy(bucketName)
+	if err != nil {
+		return err
+	}
+
+	sid := policySid(instanceID)
+	statements := policy.Statement[:0]
+	for _, st := range policy.Statement {
+		if !strings.HasPrefix(st.Sid, sid) {
+			statements = append(statements, st)
+		}
+	}
+	policy.Statement = statements
+
+	return rgw.putBucketPolicy(bucketName, policy)
+}
+
+// Returns the bucket policy, or an empty policy if the bucket has none.
+func (c *RGWClient) getBucketPolicy(bucketName string) (*bucketPolicy, error) {
+	policy := &bucketPolicy{Version: "2012-10-17"}
+
+	out, err := c.client.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: &bucketName,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchBucketPolicy" {
+			return policy, nil
+		}
+		return nil, retErrInfof("Error fetching bucket policy of %s: %v", bucketName, err)
+	}
+
+	err = json.Unmarshal([]byte(aws.StringValue(out.Policy)), policy)
+	if err != nil {
+		return nil, retErrInfof("Error failed to unmarshal bucket policy of %s: %v", bucketName, err)
+	}
+	return policy, nil
+}
+
+// Sets the bucket policy, removing it altogether when it has no statements left.
+func (c *RGWClient) putBucketPolicy(bucketName string, policy *bucketPolicy) error {
+	if len(policy.Statement) == 0 {
+		_, err := c.client.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{
+			Bucket: &bucketName,
+		})
+		if err != nil {
+			return retErrInfof("Error removing bucket policy of %s: %v", bucketName, err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return retErrInfof("Error failed to marshal bucket policy of %s: %v", bucketName, err)
+	}
+
+	_, err = c.client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: &bucketName,
+		Policy: aws.String(string(data)),
+	})
+	if err != nil {
+		return retErrInfof("Error setting bucket policy of %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+// Deletes all the objects under the prefix.
+func (c *RGWClient) deletePrefix(bucketName, prefix string) error {
+	glog.Infof("Deleting prefix %s/%s", bucketName, prefix)
+
+	var delErr error
+	err := c.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &bucketName,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: obj.Key})
+		}
+		out, err := c.client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: &bucketName,
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err == nil && len(out.Errors) > 0 {
+			err = fmt.Errorf("%s: %s", aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+		}
+		if err != nil {
+			delErr = err
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = delErr
+	}
+	if err != nil {
+		return retErrInfof("Error deleting prefix %s/%s: %v", bucketName, prefix, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/service-catalog/pkg/brokerapi"
+)
+
+// parameters that are only meaningful when the instance is created
+var createOnlyParams = []string{
+	BUCKET_NAME,
+	BUCKETS,
+	ADOPT_BUCKET,
+	BACKEND,
+	PLACEMENT,
+	STORAGE_CLASS,
+	NOTIFICATIONS,
+	INDEX_DOCUMENT,
+	ERROR_DOCUMENT,
+	QUOTA_GB,
+}
+
+// Returns the create-only parameters of a create request, which are recorded
+// with the instance.
+func createOnlyValues(params map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, param := range createOnlyParams {
+		if val, ok := params[param]; ok {
+			values[param] = val
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// Returns the create-only parameters the instance was created with. Records
+// written before they were kept only tell the name of a single bucket.
+func (i *rgwServiceInstance) createParams() map[string]interface{} {
+	if i.CreateParameters != nil || len(i.Buckets) > 0 || i.Prefix != "" || i.AdoptedFrom != "" {
+		return i.CreateParameters
+	}
+	return map[string]interface{}{BUCKET_NAME: i.BucketName}
+}
+
+// Checks that an update doesn't change the create-only parameters. Platforms
+// such as service-catalog send all the parameters of the instance with every
+// update, so the ones that keep the value the instance was created with are
+// accepted.
+func checkCreateOnlyParams(instance *rgwServiceInstance, params map[string]interface{}) error {
+	created := instance.createParams()
+	for _, param := range createOnlyParams {
+		val, ok := params[param]
+		if !ok {
+			continue
+		}
+		old, ok := created[param]
+		if !ok || !sameParamValue(old, val) {
+			return retErrInfof("Error: parameter %q cannot be changed after the instance is created", param)
+		}
+	}
+	return nil
+}
+
+// Compares parameter values through their JSON encoding, so that values read
+// back from the instance record compare equal to the ones of the request.
+func sameParamValue(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// Implements the `UpdateServiceInstance` interface method by applying the
+// updated bucket settings to the instance buckets. Changing the plan is not
+// supported.
+func (b *broker) UpdateServiceInstance(instanceID string, req *brokerapi.CreateServiceInstanceRequest, identity *OriginatingIdentity) (*brokerapi.CreateServiceInstanceResponse, error) {
+	glog.Infof("UpdateServiceInstance called. instanceID: %s", instanceID)
+	unlock, err := b.lock(instanceLockKey(instanceID))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	instance, err := b.findInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.PlanID != "" && instance.PlanID != "" && req.PlanID != instance.PlanID {
+		return nil, retErrInfof("Error: changing the plan of instance %q is not supported", instanceID)
+	}
+
+	if err := checkCreateOnlyParams(instance, req.Parameters); err != nil {
+		return nil, err
+	}
+
+	plan, err := findPlan(instance.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateParams(b.updateSchema(plan), req.Parameters); err != nil {
+		return nil, err
+	}
+
+	settings, err := parseBucketSettings(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := settings.checkObjectLock(instance.ObjectLock); err != nil {
+		return nil, err
+	}
+
+	if instance.Prefix != "" {
+		if *settings != (bucketSettings{}) {
+			return nil, retErrInfof("Error: bucket settings are not supported by shared bucket instances")
+		}
+	} else if err := b.applyBucketSettings(instance, settings); err != nil {
+		return nil, err
+	}
+
+	instance.LastModifiedBy = identity
+	if err := b.storeInstanceInfo(instanceID, *instance); err != nil {
+		return nil, retErrInfof("Error: failed to store instance info: %s", err)
+	}
+	b.cacheInstance(instanceID, instance)
+
+	glog.Infof("Update instance %q succeeded.", instanceID)
+	return &brokerapi.CreateServiceInstanceResponse{}, nil
+}
+
+// Applies the updated settings to the buckets of the instance.
+func (b *broker) applyBucketSettings(instance *rgwServiceInstance, settings *bucketSettings) error {
+	rgw, err := b.instanceBackend(instance)
+	if err != nil {
+		return err
+	}
+
+	client, cleanup, err := instanceClient(rgw, instance)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return settings.apply(client, instance)
+}
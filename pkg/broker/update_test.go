@@ -0,0 +1,85 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSameParamValue(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want bool
+	}{
+		{name: "same string", a: "data", b: "data", want: true},
+		{name: "other string", a: "data", b: "logs", want: false},
+		{name: "int and float", a: 10, b: float64(10), want: true},
+		{name: "same list", a: []string{"a", "b"}, b: []interface{}{"a", "b"}, want: true},
+		{name: "reordered list", a: []string{"a", "b"}, b: []interface{}{"b", "a"}, want: false},
+		{name: "same object", a: map[string]interface{}{"x": 1, "y": "z"}, b: map[string]interface{}{"y": "z", "x": float64(1)}, want: true},
+		{name: "string and number", a: "10", b: 10, want: false},
+		{name: "unencodable", a: func() {}, b: func() {}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameParamValue(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameParamValue(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCreateOnlyParams(t *testing.T) {
+	// the instance as read back from its record
+	var created map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"bucketName":"data","quotaGB":10,"buckets":["a","b"]}`), &created); err != nil {
+		t.Fatal(err)
+	}
+	instance := &rgwServiceInstance{BucketName: "data-a", Buckets: map[string]string{"a": "data-a", "b": "data-b"}, CreateParameters: created}
+	legacy := &rgwServiceInstance{BucketName: "old-bucket"}
+
+	tests := []struct {
+		name     string
+		instance *rgwServiceInstance
+		params   map[string]interface{}
+		wantErr  bool
+	}{
+		{name: "no create-only parameters", instance: instance, params: map[string]interface{}{VERSIONING: true}},
+		{
+			name:     "unchanged values",
+			instance: instance,
+			params:   map[string]interface{}{BUCKET_NAME: "data", QUOTA_GB: 10, BUCKETS: []interface{}{"a", "b"}},
+		},
+		{name: "changed value", instance: instance, params: map[string]interface{}{QUOTA_GB: 20}, wantErr: true},
+		{name: "added parameter", instance: instance, params: map[string]interface{}{PLACEMENT: "ssd"}, wantErr: true},
+		{name: "legacy record bucket name", instance: legacy, params: map[string]interface{}{BUCKET_NAME: "old-bucket"}},
+		{name: "legacy record other name", instance: legacy, params: map[string]interface{}{BUCKET_NAME: "new-bucket"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCreateOnlyParams(tt.instance, tt.params)
+			if tt.wantErr && err == nil {
+				t.Errorf("checkCreateOnlyParams() succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("checkCreateOnlyParams() = %v, want no error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+// the time format of the RGW usage log queries
+const usageTimeFormat = "2006-01-02 15:04:05"
+
+// BucketUsage is the storage used by a bucket, or by the prefix of a shared
+// bucket instance.
+type BucketUsage struct {
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix,omitempty"`
+	SizeBytes int64  `json:"sizeBytes"`
+	Objects   int64  `json:"objects"`
+}
+
+// TrafficUsage is the traffic of a user, as recorded by the RGW usage log.
+type TrafficUsage struct {
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+	Ops           int64 `json:"ops"`
+	SuccessfulOps int64 `json:"successfulOps"`
+}
+
+func (t *TrafficUsage) add(o TrafficUsage) {
+	t.BytesSent += o.BytesSent
+	t.BytesReceived += o.BytesReceived
+	t.Ops += o.Ops
+	t.SuccessfulOps += o.SuccessfulOps
+}
+
+// InstanceUsage is the storage currently used by an instance, and its traffic
+// over the requested time range.
+type InstanceUsage struct {
+	InstanceID string        `json:"instanceId"`
+	Namespace  string        `json:"namespace,omitempty"`
+	PlanID     string        `json:"planId,omitempty"`
+	UserName   string        `json:"userName"`
+	Buckets    []BucketUsage `json:"buckets"`
+	SizeBytes  int64         `json:"sizeBytes"`
+	Objects    int64         `json:"objects"`
+	Traffic    TrafficUsage  `json:"traffic"`
+}
+
+// NamespaceUsage is the usage of all the instances of a namespace.
+type NamespaceUsage struct {
+	Namespace string          `json:"namespace"`
+	Instances []InstanceUsage `json:"instances"`
+	SizeBytes int64           `json:"sizeBytes"`
+	Objects   int64           `json:"objects"`
+	Traffic   TrafficUsage    `json:"traffic"`
+}
+
+// Implements the `InstanceUsage` interface method. The traffic is limited to
+// the start and end times when they are not zero.
+func (b *broker) InstanceUsage(instanceID string, start, end time.Time) (*InstanceUsage, error) {
+	glog.Infof("InstanceUsage called. instanceID: %s", instanceID)
+	instance, err := b.findInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return b.instanceUsage(instanceID, instance, start, end)
+}
+
+// Implements the `NamespaceUsage` interface method.
+func (b *broker) NamespaceUsage(namespace string, start, end time.Time) (*NamespaceUsage, error) {
+	glog.Infof("NamespaceUsage called. namespace: %s", namespace)
+	instances, err := b.listInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &NamespaceUsage{
+		Namespace: namespace,
+		Instances: []InstanceUsage{},
+	}
+	for _, id := range sortedInstanceIDs(instances) {
+		if instances[id].Namespace != namespace {
+			continue
+		}
+		u, err := b.instanceUsage(id, instances[id], start, end)
+		if err != nil {
+			return nil, err
+		}
+		usage.Instances = append(usage.Instances, *u)
+		usage.SizeBytes += u.SizeBytes
+		usage.Objects += u.Objects
+		usage.Traffic.add(u.Traffic)
+	}
+	return usage, nil
+}
+
+func (b *broker) instanceUsage(instanceID string, instance *rgwServiceInstance, start, end time.Time) (*InstanceUsage, error) {
+	rgw, err := b.instanceBackend(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &InstanceUsage{
+		InstanceID: instanceID,
+		Namespace:  instance.Namespace,
+		PlanID:     instance.PlanID,
+		UserName:   instance.UserName,
+		Buckets:    []BucketUsage{},
+	}
+
+	if instance.Prefix != "" {
+		bu, err := rgw.prefixUsage(instance.BucketName, instance.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		usage.Buckets = append(usage.Buckets, *bu)
+	} else {
+		for _, bucketName := range instance.bucketNames() {
+			bu, err := rgw.bucketUsage(bucketName)
+			if err != nil {
+				return nil, err
+			}
+			usage.Buckets = append(usage.Buckets, *bu)
+		}
+	}
+	for _, bu := range usage.Buckets {
+		usage.SizeBytes += bu.SizeBytes
+		usage.Objects += bu.Objects
+	}
+
+	traffic, err := rgw.userTraffic(instance.UserName, start, end)
+	if err != nil {
+		return nil, err
+	}
+	usage.Traffic = *traffic
+	return usage, nil
+}
+
+type bucketStats struct {
+	Bucket string `json:"bucket"`
+	Usage  map[string]struct {
+		Size       int64 `json:"size"`
+		SizeKb     int64 `json:"size_kb"`
+		NumObjects int64 `json:"num_objects"`
+	} `json:"usage"`
+}
+
+// Returns the bucket stats, summed over all the RGW categories (rgw.main,
+// rgw.multimeta...).
+func (rgw *RGWClient) bucketUsage(bucketName string) (*BucketUsage, error) {
+	params := make(url.Values)
+	params.Set("bucket", bucketName)
+	params.Set("stats", "True")
+
+	body, err := rgw.rgwAdminRequest("GET", "bucket", "", params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching stats of bucket %s: %v", bucketName, err)
+	}
+
+	stats := new(bucketStats)
+	if err := json.Unmarshal(body, stats); err != nil {
+		return nil, fmt.Errorf("Error failed to unmarshal stats of bucket %s: %v", bucketName, err)
+	}
+
+	usage := &BucketUsage{Bucket: bucketName}
+	for _, u := range stats.Usage {
+		size := u.Size
+		if size == 0 {
+			// older releases only report the size in KiB
+			size = u.SizeKb * 1024
+		}
+		usage.SizeBytes += size
+		usage.Objects += u.NumObjects
+	}
+	return usage, nil
+}
+
+// Returns the usage of the prefix of a shared bucket instance, which the
+// bucket stats can't tell apart, by listing its objects.
+func (rgw *RGWClient) prefixUsage(bucketName, prefix string) (*BucketUsage, error) {
+	usage := &BucketUsage{Bucket: bucketName, Prefix: prefix}
+	err := rgw.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &bucketName,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			usage.SizeBytes += aws.Int64Value(obj.Size)
+			usage.Objects++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing prefix %s/%s: %v", bucketName, prefix, err)
+	}
+	return usage, nil
+}
+
+type usageSummary struct {
+	Summary []struct {
+		User  string `json:"user"`
+		Total struct {
+			BytesSent     int64 `json:"bytes_sent"`
+			BytesReceived int64 `json:"bytes_received"`
+			Ops           int64 `json:"ops"`
+			SuccessfulOps int64 `json:"successful_ops"`
+		} `json:"total"`
+	} `json:"summary"`
+}
+
+// Returns the traffic of the user from the usage log. The usage log must be
+// enabled in RGW ("rgw enable usage log"), otherwise it is empty.
+func (rgw *RGWClient) userTraffic(userName string, start, end time.Time) (*TrafficUsage, error) {
+	params := make(url.Values)
+	params.Set("uid", userName)
+	params.Set("show-entries", "False")
+	params.Set("show-summary", "True")
+	if !start.IsZero() {
+		params.Set("start", start.UTC().Format(usageTimeFormat))
+	}
+	if !end.IsZero() {
+		params.Set("end", end.UTC().Format(usageTimeFormat))
+	}
+
+	body, err := rgw.rgwAdminRequest("GET", "usage", "", params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching usage of user %s: %v", userName, err)
+	}
+
+	summary := new(usageSummary)
+	if err := json.Unmarshal(body, summary); err != nil {
+		return nil, fmt.Errorf("Error failed to unmarshal usage of user %s: %v", userName, err)
+	}
+
+	traffic := &TrafficUsage{}
+	for _, s := range summary.Summary {
+		traffic.add(TrafficUsage{
+			BytesSent:     s.Total.BytesSent,
+			BytesReceived: s.Total.BytesReceived,
+			Ops:           s.Total.Ops,
+			SuccessfulOps: s.Total.SuccessfulOps,
+		})
+	}
+	return traffic, nil
+}
+
+// ParseReportTime parses the start or end of a usage report, given as an RFC
+// 3339 time or a YYYY-MM-DD date. An empty value gives the zero time.
+func ParseReportTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", val)
+	}
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", val)
+	}
+	return t, nil
+}
+
+// Returns all the instance records stored in the data bucket, by instance id.
+func (b *broker) listInstances() (map[string]*rgwServiceInstance, error) {
+	prefix := getInstanceOid("")
+
+	var keys []string
+	err := b.rgw.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &b.dataBucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, retErrInfof("Error listing instances in %s: %v", b.dataBucket, err)
+	}
+
+	instances := make(map[string]*rgwServiceInstance)
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, prefix)
+		instance, err := b.getInstanceInfo(id)
+		if err != nil {
+			return nil, err
+		}
+		instances[id] = instance
+	}
+	return instances, nil
+}
+
+func sortedInstanceIDs(instances map[string]*rgwServiceInstance) []string {
+	ids := make([]string, 0, len(instances))
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns the dashboard url of an instance, its usage report on the report
+// listener, or an empty string when the report url isn't configured.
+func (b *broker) dashboardURL(instanceID string) string {
+	if b.reportURL == "" {
+		return ""
+	}
+	return b.reportURL + "/v1/instances/" + instanceID + "/usage"
+}
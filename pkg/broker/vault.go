@@ -0,0 +1,91 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// vaultKeyManager creates keys in a Vault transit secrets engine, which RGW
+// uses with "rgw crypt s3 kms backend = vault" and
+// "rgw crypt vault secret engine = transit".
+type vaultKeyManager struct {
+	addr  string
+	token string
+	// mount path of the transit secrets engine
+	mount string
+
+	client *http.Client
+}
+
+// Configured through RGW_KMS_VAULT_ADDR, RGW_KMS_VAULT_TOKEN (or
+// RGW_KMS_VAULT_TOKEN_FILE) and RGW_KMS_VAULT_TRANSIT_MOUNT.
+func newVaultKeyManager(cfg KMSConfig) *vaultKeyManager {
+	m := &vaultKeyManager{
+		addr:  strings.TrimSuffix(cfg.VaultAddr, "/"),
+		token: cfg.VaultToken,
+		mount: strings.Trim(cfg.VaultTransitMount, "/"),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: http.DefaultTransport,
+		},
+	}
+	if m.mount == "" {
+		m.mount = "transit"
+	}
+	return m
+}
+
+func (m *vaultKeyManager) createKey(keyID string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"type": "aes256-gcm96",
+	})
+	if err != nil {
+		return err
+	}
+
+	url := m.addr + "/v1/" + m.mount + "/keys/" + keyID
+	glog.Infof("Creating vault transit key: %s", url)
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Error creating vault request: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", m.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending vault request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// creating an existing key with the same type is a no-op
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Error creating vault transit key %s: %v %s", keyID, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	INDEX_DOCUMENT   = "indexDocument"
+	ERROR_DOCUMENT   = "errorDocument"
+	WEBSITE_ENDPOINT = "websiteEndpoint"
+
+	websitePolicySid = "rgwBrokerWebsitePublicRead"
+)
+
+// websiteConfig holds the documents served by a website bucket.
+type websiteConfig struct {
+	indexDocument string
+	errorDocument string
+}
+
+// Parses the website parameters, which are only accepted by website plans.
+// Returns nil for other plans.
+func parseWebsite(plan *rgwPlan, params map[string]interface{}) (*websiteConfig, error) {
+	if !plan.website {
+		for _, param := range []string{INDEX_DOCUMENT, ERROR_DOCUMENT} {
+			if _, ok := params[param]; ok {
+				return nil, retErrInfof("Error: parameter %q is not supported by plan %q", param, plan.name)
+			}
+		}
+		return nil, nil
+	}
+
+	w := &websiteConfig{
+		indexDocument: "index.html",
+		errorDocument: "error.html",
+	}
+	for param, field := range map[string]*string{
+		INDEX_DOCUMENT: &w.indexDocument,
+		ERROR_DOCUMENT: &w.errorDocument,
+	} {
+		val, ok := params[param]
+		if !ok {
+			continue
+		}
+		s, ok := val.(string)
+		if !ok || s == "" {
+			return nil, retErrInfof("Error: parameter %q must be a non empty document name", param)
+		}
+		*field = s
+	}
+	if strings.Contains(w.indexDocument, "/") {
+		return nil, retErrInfof("Error: parameter %q must not contain a slash", INDEX_DOCUMENT)
+	}
+	return w, nil
+}
+
+// Returns whether the backend website plan instances are created on serves
+// websites.
+func (b *broker) websiteConfigured(plan *rgwPlan) bool {
+	rgw, err := b.getBackend(b.planBackends[plan.name])
+	return err == nil && rgw.websiteEndpoint != ""
+}
+
+// Returns the url the bucket website is served at, using virtual host style
+// access on the website endpoint of the backend.
+func (c *RGWClient) websiteURL(bucketName string) string {
+	u, err := url.Parse(c.websiteEndpoint)
+	if err != nil || u.Host == "" {
+		return c.websiteEndpoint + "/" + bucketName
+	}
+	u.Host = bucketName + "." + u.Host
+	return u.String()
+}
+
+// Enables website hosting on the bucket, and makes its objects publicly
+// readable. The policy only allows GETs of objects, not listing the bucket.
+func (c *RGWClient) setBucketWebsite(bucketName string, w *websiteConfig) error {
+	glog.Infof("Enabling website on bucket %q, index %q error %q", bucketName, w.indexDocument, w.errorDocument)
+
+	_, err := c.client.PutBucketWebsite(&s3.PutBucketWebsiteInput{
+		Bucket: &bucketName,
+		WebsiteConfiguration: &s3.WebsiteConfiguration{
+			IndexDocument: &s3.IndexDocument{Suffix: aws.String(w.indexDocument)},
+			ErrorDocument: &s3.ErrorDocument{Key: aws.String(w.errorDocument)},
+		},
+	})
+	if err != nil {
+		return retErrInfof("Error setting website of bucket %s: %v", bucketName, err)
+	}
+
+	policy, err := c.getBucketPolicy(bucketName)
+	if err != nil {
+		return err
+	}
+	policy.Statement = append(policy.Statement, policyStatement{
+		Sid:       websitePolicySid,
+		Effect:    "Allow",
+		Principal: "*",
+		Action:    []string{"s3:GetObject"},
+		Resource:  []string{"arn:aws:s3:::" + bucketName + "/*"},
+	})
+	return c.putBucketPolicy(bucketName, policy)
+}
+
+// Disables website hosting on the bucket and revokes the public access, so
+// that parked buckets are no longer served.
+func (c *RGWClient) removeBucketWebsite(bucketName string) error {
+	glog.Infof("Disabling website on bucket %q", bucketName)
+
+	policy, err := c.getBucketPolicy(bucketName)
+	if err != nil {
+		return err
+	}
+	statements := policy.Statement[:0]
+	for _, st := range policy.Statement {
+		if st.Sid != websitePolicySid {
+			statements = append(statements, st)
+		}
+	}
+	policy.Statement = statements
+	if err := c.putBucketPolicy(bucketName, policy); err != nil {
+		return err
+	}
+
+	_, err = c.client.DeleteBucketWebsite(&s3.DeleteBucketWebsiteInput{
+		Bucket: &bucketName,
+	})
+	if err != nil {
+		return retErrInfof("Error removing website of bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+// Closes the website of a website plan instance that is being removed.
+func (b *broker) closeWebsite(rgw *RGWClient, instance *rgwServiceInstance) error {
+	if instance.WebsiteEndpoint == "" {
+		return nil
+	}
+
+	client, cleanup, err := instanceClient(rgw, instance)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return client.removeBucketWebsite(instance.BucketName)
+}
@@ -29,6 +29,8 @@ import (
 	"github.com/kubernetes-incubator/service-catalog/pkg/util"
 )
 
+const originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
 type server struct {
 	broker broker.Broker
 }
@@ -42,23 +44,80 @@ func createHandler(b broker.Broker) http.Handler {
 
 	var router = mux.NewRouter()
 
-	router.HandleFunc("/v2/catalog", s.catalog).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", s.getServiceInstanceLastOperation).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{instance_id}", s.createServiceInstance).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{instance_id}", s.removeServiceInstance).Methods("DELETE")
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", s.bind).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", s.unBind).Methods("DELETE")
+	router.HandleFunc("/v2/catalog", versioned(s.catalog)).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", versioned(s.getServiceInstanceLastOperation)).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", versioned(s.getServiceInstance)).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", versioned(s.createServiceInstance)).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", versioned(s.updateServiceInstance)).Methods("PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}", versioned(s.removeServiceInstance)).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", versioned(s.getServiceBinding)).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", versioned(s.bind)).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", versioned(s.unBind)).Methods("DELETE")
+
+	return router
+}
+
+// createReportHandler creates the HTTP handler of the usage, chargeback and
+// orphan reports. They expose the usage and buckets of every tenant, so they
+// are served on a separate listener that is not exposed with the broker.
+func createReportHandler(b broker.Broker) http.Handler {
+	s := server{
+		broker: b,
+	}
+
+	var router = mux.NewRouter()
+
+	router.HandleFunc("/v1/instances/{instance_id}/usage", s.instanceUsage).Methods("GET")
+	router.HandleFunc("/v1/namespaces/{namespace}/usage", s.namespaceUsage).Methods("GET")
+	router.HandleFunc("/v1/chargeback", s.chargeback).Methods("GET")
+	router.HandleFunc("/v1/orphans", s.orphans).Methods("GET")
 
 	return router
 }
 
+// writeErrorResponse writes an error in the Open Service Broker API format,
+// where the error is explained by the "description" field.
+func writeErrorResponse(w http.ResponseWriter, code int, err error) {
+	util.WriteResponse(w, code, map[string]string{
+		"description": err.Error(),
+	})
+}
+
+// originatingIdentity decodes the identity of the platform user behind the
+// request, writing an error response if the header is invalid.
+func originatingIdentity(w http.ResponseWriter, r *http.Request) (*broker.OriginatingIdentity, bool) {
+	identity, err := broker.ParseOriginatingIdentity(r.Header.Get(originatingIdentityHeader))
+	if err != nil {
+		glog.Errorf("%v", err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return identity, true
+}
+
 // Start creates the HTTP handler based on an implementation of a
-// broker.Broker interface, and begins to listen on the specified port.
-func Run(ctx context.Context, addr string, b broker.Broker) error {
+// broker.Broker interface, and begins to listen on the specified port. The
+// reports are served on reportAddr, unless it is empty.
+func Run(ctx context.Context, addr, reportAddr string, b broker.Broker) error {
+	errs := make(chan error, 2)
+	if reportAddr != "" {
+		glog.Infof("Starting report server on %v\n", reportAddr)
+		go func() {
+			errs <- serve(ctx, reportAddr, createReportHandler(b))
+		}()
+	}
 	glog.Infof("Starting server on %v\n", addr)
+	go func() {
+		errs <- serve(ctx, addr, createHandler(b))
+	}()
+	return <-errs
+}
+
+// serve listens on addr until the context is done.
+func serve(ctx context.Context, addr string, handler http.Handler) error {
 	srv := http.Server{
 		Addr:    addr,
-		Handler: createHandler(b),
+		Handler: handler,
 	}
 	go func() {
 		<-ctx.Done()
@@ -71,14 +130,37 @@ func Run(ctx context.Context, addr string, b broker.Broker) error {
 	return srv.ListenAndServe()
 }
 
+// retrievableService adds the flags of API 2.14 telling the platform that
+// instances and bindings can be fetched.
+type retrievableService struct {
+	*brokerapi.Service
+	InstancesRetrievable bool `json:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable"`
+}
+
 func (s *server) catalog(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Server: catalog")
 
-	if result, err := s.broker.Catalog(); err == nil {
+	result, err := s.broker.Catalog()
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if !requestAPIVersion(r).atLeast(fetchAPIVersion) {
 		util.WriteResponse(w, http.StatusOK, result)
-	} else {
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	services := make([]retrievableService, 0, len(result.Services))
+	for _, service := range result.Services {
+		services = append(services, retrievableService{
+			Service:              service,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+		})
 	}
+	util.WriteResponse(w, http.StatusOK, map[string]interface{}{
+		"services": services,
+	})
 }
 
 func (s *server) getServiceInstanceLastOperation(w http.ResponseWriter, r *http.Request) {
@@ -91,18 +173,36 @@ func (s *server) getServiceInstanceLastOperation(w http.ResponseWriter, r *http.
 	if result, err := s.broker.GetServiceInstanceLastOperation(instanceID, serviceID, planID, operation); err == nil {
 		util.WriteResponse(w, http.StatusOK, result)
 	} else {
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+func (s *server) getServiceInstance(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: getServiceInstance")
+	if !requestAPIVersion(r).atLeast(fetchAPIVersion) {
+		writeErrorResponse(w, http.StatusNotFound, fmt.Errorf("fetching an instance requires API version %s", fetchAPIVersion))
+		return
+	}
+	instanceID := mux.Vars(r)["instance_id"]
+	if result, err := s.broker.GetServiceInstance(instanceID); err == nil {
+		util.WriteResponse(w, http.StatusOK, result)
+	} else {
+		writeErrorResponse(w, http.StatusNotFound, err)
 	}
 }
 
 func (s *server) createServiceInstance(w http.ResponseWriter, r *http.Request) {
 	glog.Info("Server: createServiceInstance")
 	id := mux.Vars(r)["instance_id"]
+	identity, ok := originatingIdentity(w, r)
+	if !ok {
+		return
+	}
 
 	var req brokerapi.CreateServiceInstanceRequest
 	if err := util.BodyToObject(r, &req); err != nil {
 		glog.Errorf("error unmarshalling: %v", err)
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -113,24 +213,69 @@ func (s *server) createServiceInstance(w http.ResponseWriter, r *http.Request) {
 		req.Parameters = make(map[string]interface{})
 	}
 
-	if result, err := s.broker.CreateServiceInstance(id, &req); err == nil {
+	if result, err := s.broker.CreateServiceInstance(id, &req, identity); err == nil {
 		util.WriteResponse(w, http.StatusCreated, result)
 	} else {
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+func (s *server) updateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: updateServiceInstance")
+	id := mux.Vars(r)["instance_id"]
+	identity, ok := originatingIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	var req brokerapi.CreateServiceInstanceRequest
+	if err := util.BodyToObject(r, &req); err != nil {
+		glog.Errorf("error unmarshalling: %v", err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Parameters == nil {
+		req.Parameters = make(map[string]interface{})
+	}
+
+	if result, err := s.broker.UpdateServiceInstance(id, &req, identity); err == nil {
+		util.WriteResponse(w, http.StatusOK, result)
+	} else {
+		writeErrorResponse(w, http.StatusBadRequest, err)
 	}
 }
 
 func (s *server) removeServiceInstance(w http.ResponseWriter, r *http.Request) {
 	glog.Info("Server: removeServiceInstance")
 	instanceID := mux.Vars(r)["instance_id"]
+	identity, ok := originatingIdentity(w, r)
+	if !ok {
+		return
+	}
 	q := r.URL.Query()
 	serviceID := q.Get("service_id")
 	planID := q.Get("plan_id")
 	acceptsIncomplete := q.Get("accepts_incomplete") == "true"
-	if result, err := s.broker.RemoveServiceInstance(instanceID, serviceID, planID, acceptsIncomplete); err == nil {
+	if result, err := s.broker.RemoveServiceInstance(instanceID, serviceID, planID, acceptsIncomplete, identity); err == nil {
+		util.WriteResponse(w, http.StatusOK, result)
+	} else {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+func (s *server) getServiceBinding(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: getServiceBinding")
+	if !requestAPIVersion(r).atLeast(fetchAPIVersion) {
+		writeErrorResponse(w, http.StatusNotFound, fmt.Errorf("fetching a binding requires API version %s", fetchAPIVersion))
+		return
+	}
+	instanceID := mux.Vars(r)["instance_id"]
+	bindingID := mux.Vars(r)["binding_id"]
+	if result, err := s.broker.GetServiceBinding(instanceID, bindingID); err == nil {
 		util.WriteResponse(w, http.StatusOK, result)
 	} else {
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusNotFound, err)
 	}
 }
 
@@ -138,11 +283,15 @@ func (s *server) bind(w http.ResponseWriter, r *http.Request) {
 	glog.Info("Server: bind")
 	bindingID := mux.Vars(r)["binding_id"]
 	instanceID := mux.Vars(r)["instance_id"]
+	identity, ok := originatingIdentity(w, r)
+	if !ok {
+		return
+	}
 
 	var req brokerapi.BindingRequest
 	if err := util.BodyToObject(r, &req); err != nil {
 		glog.Errorf("Failed to unmarshall request: %v", err)
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -153,13 +302,10 @@ func (s *server) bind(w http.ResponseWriter, r *http.Request) {
 		req.Parameters = make(map[string]interface{})
 	}
 
-	// Pass in the instanceId to the template.
-	req.Parameters["instanceId"] = instanceID
-
-	if result, err := s.broker.Bind(instanceID, bindingID, &req); err == nil {
+	if result, err := s.broker.Bind(instanceID, bindingID, &req, identity); err == nil {
 		util.WriteResponse(w, http.StatusOK, result)
 	} else {
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
 	}
 }
 
@@ -167,14 +313,111 @@ func (s *server) unBind(w http.ResponseWriter, r *http.Request) {
 	glog.Info("Server: unbind")
 	instanceID := mux.Vars(r)["instance_id"]
 	bindingID := mux.Vars(r)["binding_id"]
+	identity, ok := originatingIdentity(w, r)
+	if !ok {
+		return
+	}
 	q := r.URL.Query()
 	serviceID := q.Get("service_id")
 	planID := q.Get("plan_id")
-	if err := s.broker.UnBind(instanceID, bindingID, serviceID, planID); err == nil {
+	if err := s.broker.UnBind(instanceID, bindingID, serviceID, planID, identity); err == nil {
 		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprint(w, "{}") //id)
 	} else {
-		util.WriteErrorResponse(w, http.StatusBadRequest, err)
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+// Parses the optional "start" and "end" query parameters, as RFC 3339 times or
+// YYYY-MM-DD dates.
+func timeRange(r *http.Request) (time.Time, time.Time, error) {
+	start, err := broker.ParseReportTime(r.URL.Query().Get("start"))
+	if err != nil {
+		return start, start, err
+	}
+	end, err := broker.ParseReportTime(r.URL.Query().Get("end"))
+	return start, end, err
+}
+
+func (s *server) instanceUsage(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: instanceUsage")
+	instanceID := mux.Vars(r)["instance_id"]
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if result, err := s.broker.InstanceUsage(instanceID, start, end); err == nil {
+		util.WriteResponse(w, http.StatusOK, result)
+	} else {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+func (s *server) namespaceUsage(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: namespaceUsage")
+	namespace := mux.Vars(r)["namespace"]
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if result, err := s.broker.NamespaceUsage(namespace, start, end); err == nil {
+		util.WriteResponse(w, http.StatusOK, result)
+	} else {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	}
+}
+
+func (s *server) chargeback(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: chargeback")
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	contentType := "text/csv"
+	switch format {
+	case "", broker.CHARGEBACK_CSV:
+		format = broker.CHARGEBACK_CSV
+	case broker.CHARGEBACK_JSONL:
+		contentType = "application/x-ndjson"
+	default:
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid format %q", format))
+		return
+	}
+
+	report, err := s.broker.Chargeback(start, end)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if err := report.Write(w, format); err != nil {
+		glog.Errorf("Failed to write chargeback report: %v", err)
+	}
+}
+
+// Reports the orphans, with the ones changed less than "minAge" ago, a
+// duration such as "48h", marked as too recent. The orphans are only changed
+// by the orphans command, since the report listener has no authentication.
+func (s *server) orphans(w http.ResponseWriter, r *http.Request) {
+	glog.Info("Server: orphans")
+	minAge := broker.DEFAULT_ORPHAN_MIN_AGE
+	if val := r.URL.Query().Get("minAge"); val != "" {
+		var err error
+		if minAge, err = time.ParseDuration(val); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid minAge %q: %v", val, err))
+			return
+		}
+	}
+
+	if result, err := s.broker.ScanOrphans(broker.ORPHAN_REPORT, minAge); err == nil {
+		util.WriteResponse(w, http.StatusOK, result)
+	} else {
+		writeErrorResponse(w, http.StatusBadRequest, err)
 	}
 }
@@ -0,0 +1,107 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const apiVersionHeader = "X-Broker-API-Version"
+
+// apiVersion is a version of the Open Service Broker API, as sent by the
+// platform in the X-Broker-API-Version header.
+type apiVersion struct {
+	major int
+	minor int
+}
+
+var (
+	// the oldest and newest versions of the API the broker speaks
+	minAPIVersion = apiVersion{2, 11}
+	maxAPIVersion = apiVersion{2, 14}
+
+	// the version adding the instance and binding GET endpoints
+	fetchAPIVersion = apiVersion{2, 14}
+)
+
+type apiVersionKey struct{}
+
+func parseAPIVersion(header string) (apiVersion, error) {
+	var v apiVersion
+	parts := strings.Split(strings.TrimSpace(header), ".")
+	if len(parts) != 2 {
+		return v, fmt.Errorf("invalid %s %q, expected <major>.<minor>", apiVersionHeader, header)
+	}
+	var err error
+	if v.major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("invalid %s %q, expected <major>.<minor>", apiVersionHeader, header)
+	}
+	if v.minor, err = strconv.Atoi(parts[1]); err != nil {
+		return v, fmt.Errorf("invalid %s %q, expected <major>.<minor>", apiVersionHeader, header)
+	}
+	return v, nil
+}
+
+func (v apiVersion) atLeast(o apiVersion) bool {
+	return v.major > o.major || (v.major == o.major && v.minor >= o.minor)
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// versioned rejects the requests of platforms that send a malformed or
+// unsupported version of the API with 412 Precondition Failed, and hands the
+// negotiated version to the handler through the request context. Requests
+// without a version, from platforms that predate the header, are served as the
+// oldest supported version. Newer minor versions than the broker knows are
+// served as the newest one it knows, since minor versions are backward
+// compatible.
+func versioned(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := minAPIVersion
+		if header := r.Header.Get(apiVersionHeader); header != "" {
+			var err error
+			if v, err = parseAPIVersion(header); err != nil {
+				writeErrorResponse(w, http.StatusPreconditionFailed, err)
+				return
+			}
+		}
+		if v.major != maxAPIVersion.major || !v.atLeast(minAPIVersion) {
+			writeErrorResponse(w, http.StatusPreconditionFailed,
+				fmt.Errorf("unsupported API version %s, the broker supports %s to %s", v, minAPIVersion, maxAPIVersion))
+			return
+		}
+		if v.atLeast(maxAPIVersion) {
+			v = maxAPIVersion
+		}
+		w.Header().Set(apiVersionHeader, v.String())
+		h(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	}
+}
+
+// Returns the API version negotiated for the request.
+func requestAPIVersion(r *http.Request) apiVersion {
+	if v, ok := r.Context().Value(apiVersionKey{}).(apiVersion); ok {
+		return v
+	}
+	return minAPIVersion
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAPIVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    apiVersion
+		wantErr bool
+	}{
+		{header: "2.13", want: apiVersion{2, 13}},
+		{header: " 2.14 ", want: apiVersion{2, 14}},
+		{header: "3.0", want: apiVersion{3, 0}},
+		{header: "2", wantErr: true},
+		{header: "2.13.1", wantErr: true},
+		{header: "two.13", wantErr: true},
+		{header: "2.x", wantErr: true},
+		{header: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseAPIVersion(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseAPIVersion(%q) = %v, want an error", tt.header, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAPIVersion(%q) failed: %v", tt.header, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseAPIVersion(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantCode    int
+		wantVersion string
+	}{
+		{name: "missing", header: "", wantCode: http.StatusOK, wantVersion: "2.11"},
+		{name: "invalid", header: "latest", wantCode: http.StatusPreconditionFailed},
+		{name: "too old", header: "2.10", wantCode: http.StatusPreconditionFailed},
+		{name: "other major", header: "3.0", wantCode: http.StatusPreconditionFailed},
+		{name: "oldest", header: "2.11", wantCode: http.StatusOK, wantVersion: "2.11"},
+		{name: "newest", header: "2.14", wantCode: http.StatusOK, wantVersion: "2.14"},
+		{name: "newer minor", header: "2.15", wantCode: http.StatusOK, wantVersion: "2.14"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := versioned(func(w http.ResponseWriter, r *http.Request) {
+				got = requestAPIVersion(r).String()
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest("GET", "/v2/catalog", nil)
+			if tt.header != "" {
+				r.Header.Set(apiVersionHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("versioned() answered %d, want %d", w.Code, tt.wantCode)
+			}
+			if got != tt.wantVersion {
+				t.Errorf("versioned() handed version %q, want %q", got, tt.wantVersion)
+			}
+			if tt.wantVersion != "" && w.Header().Get(apiVersionHeader) != tt.wantVersion {
+				t.Errorf("versioned() answered version %q, want %q", w.Header().Get(apiVersionHeader), tt.wantVersion)
+			}
+		})
+	}
+}